@@ -0,0 +1,428 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jpillora/backoff"
+	v1 "k8s.io/api/core/v1"
+)
+
+// Number of times an alert is sent before giving up, and how long to wait
+// between attempts.
+const alertMaxAttempts = 5
+
+// How long Close waits for alerts that are being sent.
+const alertCloseTimeout = 10 * time.Second
+
+var alertBackoff = backoff.Backoff{Min: time.Second, Max: 30 * time.Second}
+
+type AlertGrouping string
+
+const (
+	AlertGroupByRule      AlertGrouping = "rule"
+	AlertGroupByPod       AlertGrouping = "pod"
+	AlertGroupByContainer AlertGrouping = "container"
+	AlertGroupByWorkload  AlertGrouping = "workload"
+)
+
+// AlertRule describes when to post an alert to a webhook.
+type AlertRule struct {
+	Name     string
+	Pattern  *regexp.Regexp
+	Level    LogLevel // Minimum level; LogLevelUnknown matches any line
+	Cooldown time.Duration
+	GroupBy  AlertGrouping
+	Webhook  string
+}
+
+func buildAlertRules(configs []AlertRuleConfig, defaultWebhook string, defaultCooldown time.Duration) ([]AlertRule, error) {
+	rules := make([]AlertRule, 0, len(configs))
+	for i, c := range configs {
+		rule := AlertRule{
+			Name:     c.Name,
+			Cooldown: time.Duration(c.Cooldown),
+			GroupBy:  AlertGrouping(c.GroupBy),
+			Webhook:  c.Webhook,
+		}
+		if rule.Name == "" {
+			rule.Name = fmt.Sprintf("rule-%d", i+1)
+		}
+		if c.Pattern == "" {
+			return nil, fmt.Errorf("alert rule %q has no pattern", rule.Name)
+		}
+		var err error
+		if rule.Pattern, err = regexp.Compile(c.Pattern); err != nil {
+			return nil, fmt.Errorf("invalid pattern for alert rule %q: %w", rule.Name, err)
+		}
+		if c.Level != "" {
+			if rule.Level = parseLogLevel(c.Level); rule.Level == LogLevelUnknown {
+				return nil, fmt.Errorf("invalid level %q for alert rule %q", c.Level, rule.Name)
+			}
+		}
+		switch rule.GroupBy {
+		case "":
+			rule.GroupBy = AlertGroupByContainer
+		case AlertGroupByRule, AlertGroupByPod, AlertGroupByContainer, AlertGroupByWorkload:
+		default:
+			return nil, fmt.Errorf("invalid groupBy %q for alert rule %q", c.GroupBy, rule.Name)
+		}
+		if rule.Cooldown <= 0 {
+			rule.Cooldown = defaultCooldown
+		}
+		if rule.Webhook == "" {
+			rule.Webhook = defaultWebhook
+		}
+		if rule.Webhook == "" {
+			return nil, fmt.Errorf("alert rule %q has no webhook URL", rule.Name)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// alertPayload is the JSON body posted to the webhook.
+type alertPayload struct {
+	// Text is a one-line summary, which makes the payload directly usable
+	// with Slack-compatible incoming webhooks.
+	Text       string    `json:"text"`
+	Rule       string    `json:"rule"`
+	GroupKey   string    `json:"groupKey"`
+	Namespace  string    `json:"namespace"`
+	Pod        string    `json:"pod"`
+	Container  string    `json:"container"`
+	Node       string    `json:"node,omitempty"`
+	Timestamp  time.Time `json:"timestamp"`
+	Level      LogLevel  `json:"level"`
+	Message    string    `json:"message"`
+	Before     []string  `json:"before"`
+	After      []string  `json:"after"`
+	Suppressed int       `json:"suppressed"`
+}
+
+type pendingAlert struct {
+	rule    *AlertRule
+	payload *alertPayload
+	timer   *time.Timer
+}
+
+type alertContainerState struct {
+	recent  []string
+	pending []*pendingAlert
+}
+
+type alertGroupState struct {
+	lastFired  time.Time
+	suppressed int
+	// Forgets the group at the end of the cooldown
+	timer *time.Timer
+}
+
+// Alerter matches log lines against alert rules and posts matching lines,
+// along with the lines surrounding them, to webhooks. Each rule and grouping
+// key fires at most once per cooldown period; matches during the cooldown
+// are counted and reported with the next alert.
+type Alerter struct {
+	rules        []AlertRule
+	contextLines int
+	contextWait  time.Duration
+	client       *http.Client
+	containers   map[string]*alertContainerState
+	groups       map[string]*alertGroupState
+	posts        sync.WaitGroup
+	ctx          context.Context
+	cancel       context.CancelFunc
+	sync.Mutex
+}
+
+func NewAlerter(rules []AlertRule, contextLines int, client *http.Client) *Alerter {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Alerter{
+		rules:        rules,
+		contextLines: contextLines,
+		contextWait:  2 * time.Second,
+		client:       client,
+		containers:   map[string]*alertContainerState{},
+		groups:       map[string]*alertGroupState{},
+		ctx:          ctx,
+		cancel:       cancel,
+	}
+}
+
+// Close sends the alerts that are waiting for more context, and waits for
+// alerts that are being sent, giving up on them after a while.
+func (a *Alerter) Close() {
+	a.Lock()
+	for key, state := range a.containers {
+		pending := state.pending
+		state.pending = nil
+		for _, p := range pending {
+			a.fire(p)
+		}
+		delete(a.containers, key)
+	}
+	for _, group := range a.groups {
+		if group.timer != nil {
+			group.timer.Stop()
+		}
+	}
+	a.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		a.posts.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(alertCloseTimeout):
+		printError("Gave up waiting for alerts to be sent")
+	}
+	a.cancel()
+}
+
+func (a *Alerter) OnEvent(event *LogEvent) {
+	if event.Kind != LogEventKindLog {
+		return
+	}
+
+	a.Lock()
+	defer a.Unlock()
+
+	key := buildKey(event.Pod, event.Container)
+	state, ok := a.containers[key]
+	if !ok {
+		state = &alertContainerState{}
+		a.containers[key] = state
+	}
+
+	pending := state.pending[:0]
+	for _, p := range state.pending {
+		p.payload.After = append(p.payload.After, event.Message)
+		if len(p.payload.After) >= a.contextLines {
+			a.fire(p)
+		} else {
+			pending = append(pending, p)
+		}
+	}
+	state.pending = pending
+
+	for i := range a.rules {
+		rule := &a.rules[i]
+		if !rule.Pattern.MatchString(event.Message) {
+			continue
+		}
+		level := event.Level()
+		if level < rule.Level {
+			continue
+		}
+
+		groupKey := rule.Name + "/" + alertGroupKey(rule.GroupBy, event.Pod, event.Container)
+		group, ok := a.groups[groupKey]
+		if !ok {
+			group = &alertGroupState{}
+			a.groups[groupKey] = group
+		}
+		if !group.lastFired.IsZero() && time.Since(group.lastFired) < rule.Cooldown {
+			group.suppressed++
+			continue
+		}
+		group.lastFired = time.Now()
+		a.forgetAfterCooldown(groupKey, group, rule.Cooldown)
+
+		p := &pendingAlert{
+			rule: rule,
+			payload: &alertPayload{
+				Rule:       rule.Name,
+				GroupKey:   groupKey,
+				Namespace:  event.Pod.Namespace,
+				Pod:        event.Pod.Name,
+				Container:  event.Container.Name,
+				Node:       event.Pod.Spec.NodeName,
+				Timestamp:  *event.Timestamp,
+				Level:      level,
+				Message:    event.Message,
+				Before:     append([]string{}, state.recent...),
+				After:      []string{},
+				Suppressed: group.suppressed,
+			},
+		}
+		group.suppressed = 0
+		if a.contextLines == 0 {
+			a.fire(p)
+			continue
+		}
+		p.timer = time.AfterFunc(a.contextWait, func() {
+			a.Lock()
+			defer a.Unlock()
+			for i, other := range state.pending {
+				if other == p {
+					state.pending = append(state.pending[:i], state.pending[i+1:]...)
+					a.fire(p)
+					break
+				}
+			}
+		})
+		state.pending = append(state.pending, p)
+	}
+
+	if a.contextLines > 0 {
+		if len(state.recent) >= a.contextLines {
+			state.recent = state.recent[1:]
+		}
+		state.recent = append(state.recent, event.Message)
+	}
+}
+
+// OnExit discards the state of a container that is no longer tailed, after
+// sending any alerts that are waiting for more context.
+func (a *Alerter) OnExit(pod *v1.Pod, container *v1.Container) {
+	a.Lock()
+	defer a.Unlock()
+
+	key := buildKey(pod, container)
+	if state, ok := a.containers[key]; ok {
+		pending := state.pending
+		// A timer that has already expired may be waiting for the lock, and
+		// must not find its alert still pending
+		state.pending = nil
+		for _, p := range pending {
+			a.fire(p)
+		}
+		delete(a.containers, key)
+	}
+}
+
+func (a *Alerter) fire(p *pendingAlert) {
+	if p.timer != nil {
+		p.timer.Stop()
+	}
+	p.payload.Text = fmt.Sprintf("[%s/%s:%s] %s", p.payload.Namespace, p.payload.Pod,
+		p.payload.Container, p.payload.Message)
+	if p.payload.Suppressed > 0 {
+		p.payload.Text += fmt.Sprintf(" (%d similar alerts suppressed)", p.payload.Suppressed)
+	}
+	a.posts.Add(1)
+	go func() {
+		defer a.posts.Done()
+		if err := a.post(p.rule.Webhook, p.payload); err != nil {
+			printError("Could not send alert %q: %s", p.rule.Name, err)
+		}
+	}()
+}
+
+// forgetAfterCooldown removes a group once its cooldown has passed, so that
+// groups for pods that are long gone don't pile up. A group with suppressed
+// matches is kept, so that they are reported with the next alert.
+func (a *Alerter) forgetAfterCooldown(groupKey string, group *alertGroupState, cooldown time.Duration) {
+	if group.timer != nil {
+		group.timer.Stop()
+	}
+	group.timer = time.AfterFunc(cooldown, func() {
+		a.Lock()
+		defer a.Unlock()
+		if a.groups[groupKey] == group && group.suppressed == 0 {
+			delete(a.groups, groupKey)
+		}
+	})
+}
+
+// post sends an alert, retrying with backoff when the webhook can't be
+// reached or asks to try again later.
+func (a *Alerter) post(url string, payload *alertPayload) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	boff := alertBackoff
+	for attempt := 1; ; attempt++ {
+		err := a.postOnce(url, body)
+		if err == nil {
+			return nil
+		}
+		var statusErr *alertStatusError
+		if attempt == alertMaxAttempts || (errors.As(err, &statusErr) && !statusErr.retryable()) {
+			return err
+		}
+		timer := time.NewTimer(boff.Duration())
+		select {
+		case <-a.ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+	}
+}
+
+func (a *Alerter) postOnce(url string, body []byte) error {
+	req, err := http.NewRequestWithContext(a.ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return &alertStatusError{status: resp.Status, code: resp.StatusCode, message: strings.TrimSpace(string(b))}
+	}
+	return nil
+}
+
+type alertStatusError struct {
+	status  string
+	code    int
+	message string
+}
+
+func (e *alertStatusError) Error() string {
+	return fmt.Sprintf("webhook returned %s: %s", e.status, e.message)
+}
+
+// retryable returns whether the alert might be accepted if sent again.
+func (e *alertStatusError) retryable() bool {
+	return e.code == http.StatusTooManyRequests || e.code >= 500
+}
+
+func alertGroupKey(groupBy AlertGrouping, pod *v1.Pod, container *v1.Container) string {
+	switch groupBy {
+	case AlertGroupByRule:
+		return ""
+	case AlertGroupByPod:
+		return pod.Namespace + "/" + pod.Name
+	case AlertGroupByWorkload:
+		return pod.Namespace + "/" + workloadName(pod) + ":" + container.Name
+	default:
+		return buildKey(pod, container)
+	}
+}
+
+// workloadName returns the name of the workload that owns a pod, so that
+// all replicas of a deployment, including ones replaced after crashing, map
+// to the same name.
+func workloadName(pod *v1.Pod) string {
+	for _, ref := range pod.OwnerReferences {
+		if ref.Controller == nil || !*ref.Controller {
+			continue
+		}
+		if hash, ok := pod.Labels["pod-template-hash"]; ok && ref.Kind == "ReplicaSet" {
+			return strings.TrimSuffix(ref.Name, "-"+hash)
+		}
+		return ref.Name
+	}
+	return pod.Name
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// receivedAlert is an alert as decoded by a webhook.
+type receivedAlert struct {
+	alertPayload
+	Level string `json:"level"`
+}
+
+// alertReceiver is a webhook that records the alerts posted to it, and
+// responds to them with the given statuses in turn, and then with 200.
+type alertReceiver struct {
+	*httptest.Server
+	alerts   chan receivedAlert
+	statuses []int
+	sync.Mutex
+}
+
+func newAlertReceiver(t *testing.T, statuses ...int) *alertReceiver {
+	r := &alertReceiver{alerts: make(chan receivedAlert, 100), statuses: statuses}
+	r.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var payload receivedAlert
+		if err := json.NewDecoder(req.Body).Decode(&payload); err != nil {
+			t.Errorf("invalid alert body: %s", err)
+		}
+		if ct := req.Header.Get("Content-Type"); ct != "application/json" {
+			t.Errorf("got content type %q", ct)
+		}
+		r.alerts <- payload
+
+		r.Lock()
+		status := http.StatusOK
+		if len(r.statuses) > 0 {
+			status, r.statuses = r.statuses[0], r.statuses[1:]
+		}
+		r.Unlock()
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(r.Close)
+	return r
+}
+
+func (r *alertReceiver) next(t *testing.T) receivedAlert {
+	t.Helper()
+	select {
+	case payload := <-r.alerts:
+		return payload
+	case <-time.After(5 * time.Second):
+		t.Fatal("no alert received")
+		return receivedAlert{}
+	}
+}
+
+func (r *alertReceiver) expectNone(t *testing.T) {
+	t.Helper()
+	select {
+	case payload := <-r.alerts:
+		t.Fatalf("unexpected alert: %+v", payload)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func newTestAlerter(t *testing.T, url string, contextLines int, cooldown time.Duration) *Alerter {
+	t.Helper()
+	rules, err := buildAlertRules([]AlertRuleConfig{{Name: "panics", Pattern: "^panic:"}}, url, cooldown)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := NewAlerter(rules, contextLines, http.DefaultClient)
+	a.contextWait = 50 * time.Millisecond
+	t.Cleanup(a.Close)
+	return a
+}
+
+func TestAlerterPayload(t *testing.T) {
+	receiver := newAlertReceiver(t, http.StatusOK)
+	a := newTestAlerter(t, receiver.URL, 2, time.Hour)
+
+	pod := newTestPod("default", "web")
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	for _, message := range []string{"one", "two", "three", "panic: boom", "four", "five", "six"} {
+		a.OnEvent(newTestLogEvent(pod, now, message))
+	}
+
+	payload := receiver.next(t)
+	if payload.Rule != "panics" || payload.Namespace != "default" || payload.Pod != "web" ||
+		payload.Container != "app" || payload.Node != "node-1" || payload.Message != "panic: boom" {
+		t.Errorf("unexpected payload: %+v", payload)
+	}
+	if payload.Text != "[default/web:app] panic: boom" {
+		t.Errorf("got text %q", payload.Text)
+	}
+	if !payload.Timestamp.Equal(now) {
+		t.Errorf("got timestamp %s", payload.Timestamp)
+	}
+	if got := strings.Join(payload.Before, ","); got != "two,three" {
+		t.Errorf("got lines before %q", got)
+	}
+	if got := strings.Join(payload.After, ","); got != "four,five" {
+		t.Errorf("got lines after %q", got)
+	}
+	receiver.expectNone(t)
+}
+
+func TestAlerterSendsWithoutFullContextAfterWaiting(t *testing.T) {
+	receiver := newAlertReceiver(t, http.StatusOK)
+	a := newTestAlerter(t, receiver.URL, 5, time.Hour)
+
+	pod := newTestPod("default", "web")
+	a.OnEvent(newTestLogEvent(pod, time.Now(), "panic: boom"))
+	a.OnEvent(newTestLogEvent(pod, time.Now(), "after"))
+
+	payload := receiver.next(t)
+	if got := strings.Join(payload.After, ","); got != "after" {
+		t.Errorf("got lines after %q", got)
+	}
+	receiver.expectNone(t)
+}
+
+func TestAlerterCooldown(t *testing.T) {
+	receiver := newAlertReceiver(t, http.StatusOK)
+	a := newTestAlerter(t, receiver.URL, 0, time.Hour)
+
+	pod := newTestPod("default", "web")
+	for i := 0; i < 3; i++ {
+		a.OnEvent(newTestLogEvent(pod, time.Now(), "panic: boom"))
+	}
+	if payload := receiver.next(t); payload.Suppressed != 0 {
+		t.Errorf("got %d suppressed in first alert", payload.Suppressed)
+	}
+	receiver.expectNone(t)
+
+	// Another container has its own cooldown
+	a.OnEvent(newTestLogEvent(newTestPod("default", "api"), time.Now(), "panic: boom"))
+	if payload := receiver.next(t); payload.Pod != "api" {
+		t.Errorf("got alert for pod %q", payload.Pod)
+	}
+
+	a.Lock()
+	for _, group := range a.groups {
+		group.lastFired = time.Now().Add(-2 * time.Hour)
+	}
+	a.Unlock()
+	a.OnEvent(newTestLogEvent(pod, time.Now(), "panic: again"))
+	payload := receiver.next(t)
+	if payload.Suppressed != 2 || !strings.HasSuffix(payload.Text, "(2 similar alerts suppressed)") {
+		t.Errorf("got %d suppressed, text %q", payload.Suppressed, payload.Text)
+	}
+}
+
+func TestAlerterOnExitFiresOnce(t *testing.T) {
+	receiver := newAlertReceiver(t, http.StatusOK)
+	a := newTestAlerter(t, receiver.URL, 5, time.Hour)
+
+	pod := newTestPod("default", "web")
+	a.OnEvent(newTestLogEvent(pod, time.Now(), "panic: boom"))
+
+	// Let the timer expire while the container is exiting, so that both
+	// compete to send the alert, with the exit getting the lock first
+	a.Lock()
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		a.OnExit(pod, &pod.Spec.Containers[0])
+	}()
+	time.Sleep(2 * a.contextWait)
+	a.Unlock()
+	wg.Wait()
+
+	receiver.next(t)
+	receiver.expectNone(t)
+}
+
+func TestAlerterCloseSendsPending(t *testing.T) {
+	receiver := newAlertReceiver(t, http.StatusServiceUnavailable)
+	a := newTestAlerter(t, receiver.URL, 5, time.Hour)
+	a.contextWait = time.Hour
+
+	pod := newTestPod("default", "web")
+	a.OnEvent(newTestLogEvent(pod, time.Now(), "panic: boom"))
+	receiver.expectNone(t)
+
+	// The first attempt fails, so Close must wait for the retry
+	saved := alertBackoff
+	alertBackoff.Min, alertBackoff.Max = 50*time.Millisecond, 50*time.Millisecond
+	t.Cleanup(func() {
+		alertBackoff = saved
+	})
+	a.Close()
+	for i := 0; i < 2; i++ {
+		select {
+		case payload := <-receiver.alerts:
+			if payload.Message != "panic: boom" {
+				t.Errorf("got payload %+v", payload)
+			}
+		default:
+			t.Fatalf("attempt %d not sent before Close returned", i+1)
+		}
+	}
+}
+
+func TestAlerterForgetsGroups(t *testing.T) {
+	receiver := newAlertReceiver(t)
+	a := newTestAlerter(t, receiver.URL, 0, 100*time.Millisecond)
+
+	web, api := newTestPod("default", "web"), newTestPod("default", "api")
+	a.OnEvent(newTestLogEvent(web, time.Now(), "panic: boom"))
+	a.OnEvent(newTestLogEvent(api, time.Now(), "panic: boom"))
+	a.OnEvent(newTestLogEvent(api, time.Now(), "panic: again"))
+	receiver.next(t)
+	receiver.next(t)
+
+	time.Sleep(300 * time.Millisecond)
+	a.Lock()
+	groups := len(a.groups)
+	a.Unlock()
+	if groups != 1 {
+		t.Fatalf("got %d groups, want only the one with suppressed alerts", groups)
+	}
+
+	a.OnEvent(newTestLogEvent(api, time.Now(), "panic: later"))
+	if payload := receiver.next(t); payload.Suppressed != 1 {
+		t.Errorf("got %d suppressed", payload.Suppressed)
+	}
+}
+
+func TestAlerterRetry(t *testing.T) {
+	saved := alertBackoff
+	alertBackoff.Min, alertBackoff.Max = time.Millisecond, time.Millisecond
+	t.Cleanup(func() {
+		alertBackoff = saved
+	})
+
+	for _, tc := range []struct {
+		name     string
+		statuses []int
+		attempts int
+		err      string
+	}{
+		{name: "success", attempts: 1},
+		{name: "server error", statuses: []int{500, 503}, attempts: 3},
+		{name: "rate limited", statuses: []int{429}, attempts: 2},
+		{name: "bad request is dropped", statuses: []int{400}, attempts: 1, err: "400"},
+		{name: "not found is dropped", statuses: []int{404}, attempts: 1, err: "404"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			receiver := newAlertReceiver(t, tc.statuses...)
+			a := newTestAlerter(t, receiver.URL, 0, time.Hour)
+
+			err := a.post(receiver.URL, &alertPayload{Rule: "panics"})
+			if tc.err == "" && err != nil || tc.err != "" && (err == nil || !strings.Contains(err.Error(), tc.err)) {
+				t.Errorf("got error %v", err)
+			}
+			for i := 0; i < tc.attempts; i++ {
+				if payload := receiver.next(t); payload.Rule != "panics" {
+					t.Errorf("attempt %d: got payload %+v", i+1, payload)
+				}
+			}
+			receiver.expectNone(t)
+		})
+	}
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+var templateMasks = []struct {
+	expr        *regexp.Regexp
+	replacement string
+}{
+	{regexp.MustCompile(`\d{4}-\d{2}-\d{2}[T ]\d{2}:\d{2}:\d{2}(?:[.,]\d+)?(?:Z|[+-]\d{2}:?\d{2})?`), "<time>"},
+	{regexp.MustCompile(`(?i)\b[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}\b`), "<uuid>"},
+	{regexp.MustCompile(`[\w.+-]+@[\w-]+\.[\w.-]+`), "<email>"},
+	{regexp.MustCompile(`\b\d{1,3}(?:\.\d{1,3}){3}(?::\d+)?\b`), "<ip>"},
+	{regexp.MustCompile(`(?i)\b(?:[0-9a-f]{1,4}:){2,7}[0-9a-f]{1,4}\b`), "<ip>"},
+	{regexp.MustCompile(`(?i)\b(?:0x[0-9a-f]+|[0-9a-f]{8,})\b`), "<hex>"},
+	{regexp.MustCompile(`-?\b\d+(?:\.\d+)?(?:ns|us|µs|ms|s|m|h|b|kb|mb|gb|KiB|MiB|GiB|%)?\b`), "<num>"},
+}
+
+// templateOf masks the variable parts of a message, such as numbers,
+// UUIDs and IP addresses, so that similar messages map to the same
+// template.
+func templateOf(message string) string {
+	for _, mask := range templateMasks {
+		message = mask.expr.ReplaceAllString(message, mask.replacement)
+	}
+	return message
+}
+
+type logCluster struct {
+	template   string
+	count      int
+	containers map[string]int
+	lastSeen   int // Value of total when last seen
+}
+
+type ClustererOptions struct {
+	Interval time.Duration
+	Top      int
+	// MaxTemplates is the maximum number of templates to keep track of.
+	// When there are more, the least common ones are discarded.
+	MaxTemplates int
+	// Live causes the table to replace the previous one by clearing the
+	// screen, which only makes sense when writing to a terminal.
+	Live bool
+}
+
+// Clusterer groups log lines into templates instead of printing them, and
+// periodically prints a table of the most frequent templates.
+type Clusterer struct {
+	ClustererOptions
+	out      io.Writer
+	clusters map[string]*logCluster
+	started  time.Time
+	total    int
+	evicted  int
+	sync.Mutex
+}
+
+func NewClusterer(options ClustererOptions, out io.Writer) *Clusterer {
+	return &Clusterer{
+		ClustererOptions: options,
+		out:              out,
+		clusters:         map[string]*logCluster{},
+		started:          time.Now(),
+	}
+}
+
+func (c *Clusterer) Write(event *LogEvent) {
+	if event.Kind != LogEventKindLog {
+		return
+	}
+
+	template := templateOf(event.Message)
+
+	c.Lock()
+	defer c.Unlock()
+
+	cluster, ok := c.clusters[template]
+	if !ok {
+		if c.MaxTemplates > 0 && len(c.clusters) >= c.MaxTemplates {
+			c.evict()
+		}
+		cluster = &logCluster{template: template, containers: map[string]int{}}
+		c.clusters[template] = cluster
+	}
+	cluster.count++
+	cluster.containers[event.Pod.Name+":"+event.Container.Name]++
+	c.total++
+	cluster.lastSeen = c.total
+}
+
+// evict discards the least common tenth of the templates, and of those with
+// the same count, the ones seen least recently. Discarding many at once
+// keeps messages that never repeat from causing a sort for every line.
+func (c *Clusterer) evict() {
+	clusters := make([]*logCluster, 0, len(c.clusters))
+	for _, cluster := range c.clusters {
+		clusters = append(clusters, cluster)
+	}
+	sort.Slice(clusters, func(i, j int) bool {
+		if clusters[i].count != clusters[j].count {
+			return clusters[i].count < clusters[j].count
+		}
+		return clusters[i].lastSeen < clusters[j].lastSeen
+	})
+	for _, cluster := range clusters[:max(1, len(clusters)/10)] {
+		delete(c.clusters, cluster.template)
+		c.evicted++
+	}
+}
+
+// Run prints the table at every interval until the context is cancelled.
+func (c *Clusterer) Run(ctx context.Context, lock sync.Locker) {
+	ticker := time.NewTicker(c.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			lock.Lock()
+			c.PrintTable()
+			lock.Unlock()
+		}
+	}
+}
+
+// PrintTable prints the most frequent templates.
+func (c *Clusterer) PrintTable() {
+	c.Lock()
+	clusters := make([]*logCluster, 0, len(c.clusters))
+	for _, cluster := range c.clusters {
+		clusters = append(clusters, &logCluster{
+			template:   cluster.template,
+			count:      cluster.count,
+			containers: copyCounts(cluster.containers),
+		})
+	}
+	total, templates, evicted := c.total, len(c.clusters), c.evicted
+	c.Unlock()
+
+	sort.Slice(clusters, func(i, j int) bool {
+		if clusters[i].count != clusters[j].count {
+			return clusters[i].count > clusters[j].count
+		}
+		return clusters[i].template < clusters[j].template
+	})
+	if c.Top > 0 && len(clusters) > c.Top {
+		clusters = clusters[:c.Top]
+	}
+
+	if c.Live {
+		_, _ = fmt.Fprint(c.out, "\x1b[H\x1b[2J")
+	}
+	_, _ = fmt.Fprintf(c.out, "%s: %d lines in %d templates over %s",
+		time.Now().Format(time.TimeOnly), total, templates,
+		time.Since(c.started).Round(time.Second))
+	if evicted > 0 {
+		_, _ = fmt.Fprintf(c.out, " (%d uncommon templates discarded)", evicted)
+	}
+	_, _ = fmt.Fprintln(c.out)
+
+	w := tabwriter.NewWriter(c.out, 0, 4, 2, ' ', 0)
+	_, _ = fmt.Fprintln(w, "COUNT\tCONTAINERS\tTEMPLATE")
+	for _, cluster := range clusters {
+		_, _ = fmt.Fprintf(w, "%d\t%s\t%s\n", cluster.count,
+			formatContainerCounts(cluster.containers, 3), cluster.template)
+	}
+	_ = w.Flush()
+	if !c.Live {
+		_, _ = fmt.Fprintln(c.out)
+	}
+}
+
+// formatContainerCounts formats the containers with the highest counts,
+// such as "foo-1:app=30 foo-2:app=27 (+3)".
+func formatContainerCounts(counts map[string]int, limit int) string {
+	names := make([]string, 0, len(counts))
+	for name := range counts {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		if counts[names[i]] != counts[names[j]] {
+			return counts[names[i]] > counts[names[j]]
+		}
+		return names[i] < names[j]
+	})
+
+	parts := []string{}
+	for i, name := range names {
+		if i == limit {
+			parts = append(parts, fmt.Sprintf("(+%d)", len(names)-limit))
+			break
+		}
+		parts = append(parts, fmt.Sprintf("%s=%d", name, counts[name]))
+	}
+	return strings.Join(parts, " ")
+}
+
+func copyCounts(m map[string]int) map[string]int {
+	result := make(map[string]int, len(m))
+	for k, v := range m {
+		result[k] = v
+	}
+	return result
+}
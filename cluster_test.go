@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestTemplateOf(t *testing.T) {
+	for _, tc := range []struct {
+		message  string
+		expected string
+	}{
+		{"took 35ms", "took <num>"},
+		{"user 3f1e2d4c-1a2b-4c3d-8e9f-0a1b2c3d4e5f logged in from 10.0.0.1:5432",
+			"user <uuid> logged in from <ip>"},
+		{"2024-05-01T12:00:00.123Z request done", "<time> request done"},
+	} {
+		if got := templateOf(tc.message); got != tc.expected {
+			t.Errorf("templateOf(%q) = %q, expected %q", tc.message, got, tc.expected)
+		}
+	}
+}
+
+func TestClustererEvictsUncommonTemplates(t *testing.T) {
+	c := NewClusterer(ClustererOptions{MaxTemplates: 10}, io.Discard)
+	pod := newTestPod("default", "web")
+	for i := 0; i < 5; i++ {
+		c.Write(newTestLogEvent(pod, time.Now(), "common message"))
+	}
+	// Templates that aren't masked, as letters are not numbers
+	for i := 0; i < 100; i++ {
+		c.Write(newTestLogEvent(pod, time.Now(), fmt.Sprintf("rare message %c%c", 'a'+i/26, 'a'+i%26)))
+	}
+
+	if len(c.clusters) > 10 {
+		t.Errorf("got %d templates", len(c.clusters))
+	}
+	if cluster, ok := c.clusters["common message"]; !ok || cluster.count != 5 {
+		t.Errorf("common template was discarded")
+	}
+	if _, ok := c.clusters["rare message dv"]; !ok {
+		t.Errorf("most recent template was discarded")
+	}
+	if c.total != 105 || c.evicted != 100+1-10 {
+		t.Errorf("got %d lines, %d discarded templates", c.total, c.evicted)
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Collapser suppresses consecutive identical messages, regardless of which
+// container they come from, and reports how many times they were repeated
+// once a different message arrives or the repeats stop.
+type Collapser struct {
+	write       func(*LogEvent)
+	idleTimeout time.Duration
+	last        *LogEvent
+	repeats     int
+	pods        map[string]struct{}
+	lastRepeat  time.Time
+	sync.Mutex
+}
+
+func NewCollapser(write func(*LogEvent)) *Collapser {
+	return &Collapser{
+		write:       write,
+		idleTimeout: time.Second,
+		pods:        map[string]struct{}{},
+	}
+}
+
+// Run periodically reports repeats that have stopped, until the context is
+// cancelled.
+func (c *Collapser) Run(ctx context.Context) {
+	ticker := time.NewTicker(c.idleTimeout / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			c.Lock()
+			if c.repeats > 0 && time.Since(c.lastRepeat) >= c.idleTimeout {
+				c.flush()
+			}
+			c.Unlock()
+		}
+	}
+}
+
+func (c *Collapser) Write(event *LogEvent) {
+	c.Lock()
+	defer c.Unlock()
+
+	if event.Kind == LogEventKindLog && c.last != nil && c.last.Message == event.Message {
+		c.repeats++
+		c.pods[event.Pod.Namespace+"/"+event.Pod.Name] = struct{}{}
+		c.lastRepeat = time.Now()
+		return
+	}
+
+	c.flush()
+	if event.Kind == LogEventKindLog {
+		c.last = event
+		c.pods = map[string]struct{}{event.Pod.Namespace + "/" + event.Pod.Name: {}}
+	} else {
+		c.last = nil
+	}
+	c.write(event)
+}
+
+// Flush reports any pending repeats.
+func (c *Collapser) Flush() {
+	c.Lock()
+	defer c.Unlock()
+	c.flush()
+}
+
+func (c *Collapser) flush() {
+	if c.repeats == 0 {
+		return
+	}
+	msg := fmt.Sprintf("Last message repeated %d times", c.repeats)
+	if len(c.pods) > 1 {
+		msg += fmt.Sprintf(" across %d pods", len(c.pods))
+	}
+	printInfo("%s", msg)
+	c.repeats = 0
+}
@@ -1,9 +1,11 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"os"
 	"path/filepath"
+	"time"
 
 	"k8s.io/apimachinery/pkg/util/yaml"
 )
@@ -17,6 +19,134 @@ type Config struct {
 	ColorScheme    string `yaml:"colorScheme"`
 	TemplateString string `yaml:"templateString"`
 	KubeConfigPath string `yaml:"kubeConfigPath"`
+	JSON           bool   `yaml:"json"`
+	Events         bool   `yaml:"events"`
+	Summary        bool   `yaml:"summary"`
+
+	IdleTimeout   Duration `yaml:"idleTimeout"`
+	PassMalformed bool     `yaml:"passMalformed"`
+
+	MaxStreams     int      `yaml:"maxStreams"`
+	StreamPriority string   `yaml:"streamPriority"`
+	StreamRotation Duration `yaml:"streamRotation"`
+
+	BufferSize   int    `yaml:"bufferSize"`
+	BufferPolicy string `yaml:"bufferPolicy"`
+
+	RateLimit float64       `yaml:"rateLimit"`
+	Sample    float64       `yaml:"sample"`
+	Limits    []LimitConfig `yaml:"limits"`
+
+	MetricsAddr     string             `yaml:"metricsAddr"`
+	Metrics         []MetricRuleConfig `yaml:"metrics"`
+	MetricMaxSeries int                `yaml:"metricMaxSeries"`
+
+	LokiURL       string   `yaml:"lokiURL"`
+	LokiTenant    string   `yaml:"lokiTenant"`
+	LokiLabels    []string `yaml:"lokiLabels"`
+	LokiBatchSize int      `yaml:"lokiBatchSize"`
+	LokiBatchWait Duration `yaml:"lokiBatchWait"`
+
+	SyslogAddress  string `yaml:"syslogAddress"`
+	SyslogFacility string `yaml:"syslogFacility"`
+	SyslogCAFile   string `yaml:"syslogCAFile"`
+	SyslogMaxSize  int    `yaml:"syslogMaxSize"`
+
+	OTLPEndpoint  string            `yaml:"otlpEndpoint"`
+	OTLPHeaders   map[string]string `yaml:"otlpHeaders"`
+	OTLPBatchSize int               `yaml:"otlpBatchSize"`
+	OTLPBatchWait Duration          `yaml:"otlpBatchWait"`
+
+	PipeCommand      string `yaml:"pipeCommand"`
+	PipeFormat       string `yaml:"pipeFormat"`
+	PipeTemplate     string `yaml:"pipeTemplate"`
+	PipeShared       bool   `yaml:"pipeShared"`
+	PipeMaxProcesses int    `yaml:"pipeMaxProcesses"`
+
+	Redact          bool                  `yaml:"redact"`
+	RedactMode      string                `yaml:"redactMode"`
+	RedactDetectors []string              `yaml:"redactDetectors"`
+	RedactPatterns  []RedactPatternConfig `yaml:"redactPatterns"`
+
+	Hooks           []HookConfig `yaml:"hooks"`
+	HookConcurrency int          `yaml:"hookConcurrency"`
+	HookTimeout     Duration     `yaml:"hookTimeout"`
+
+	Alerts        []AlertRuleConfig `yaml:"alerts"`
+	AlertWebhook  string            `yaml:"alertWebhook"`
+	AlertCooldown Duration          `yaml:"alertCooldown"`
+	AlertContext  int               `yaml:"alertContext"`
+
+	TriggerBuffer int      `yaml:"triggerBuffer"`
+	TriggerWindow Duration `yaml:"triggerWindow"`
+	TriggerAfter  Duration `yaml:"triggerAfter"`
+	TriggerAll    bool     `yaml:"triggerAll"`
+
+	Collapse            bool     `yaml:"collapse"`
+	ClusterInterval     Duration `yaml:"clusterInterval"`
+	ClusterTop          int      `yaml:"clusterTop"`
+	ClusterMaxTemplates int      `yaml:"clusterMaxTemplates"`
+
+	TopSort     string   `yaml:"topSort"`
+	TopInterval Duration `yaml:"topInterval"`
+
+	TUIHistory int `yaml:"tuiHistory"`
+
+	PickFollowOwner bool `yaml:"pickFollowOwner"`
+}
+
+type HookConfig struct {
+	On      string   `yaml:"on"`
+	Command string   `yaml:"command"`
+	Pattern string   `yaml:"pattern"`
+	Timeout Duration `yaml:"timeout"`
+}
+
+type AlertRuleConfig struct {
+	Name     string   `yaml:"name"`
+	Pattern  string   `yaml:"pattern"`
+	Level    string   `yaml:"level"`
+	Cooldown Duration `yaml:"cooldown"`
+	GroupBy  string   `yaml:"groupBy"`
+	Webhook  string   `yaml:"webhook"`
+}
+
+type LimitConfig struct {
+	Pattern string  `yaml:"pattern"`
+	Rate    float64 `yaml:"rate"`
+	Burst   int     `yaml:"burst"`
+	Sample  float64 `yaml:"sample"`
+	Every   int     `yaml:"every"`
+}
+
+type MetricRuleConfig struct {
+	Name    string    `yaml:"name"`
+	Help    string    `yaml:"help"`
+	Type    string    `yaml:"type"`
+	Pattern string    `yaml:"pattern"`
+	Buckets []float64 `yaml:"buckets"`
+}
+
+type RedactPatternConfig struct {
+	Name    string `yaml:"name"`
+	Pattern string `yaml:"pattern"`
+}
+
+// Duration is a time.Duration that is expressed in config files as a string
+// such as "30s".
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("duration must be a string such as \"30s\": %w", err)
+	}
+	dur, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(dur)
+	return nil
 }
 
 func (c *Config) LoadDefault() error {
@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"fmt"
+	"sort"
 	"sync"
 	"time"
 
@@ -21,42 +22,121 @@ type ControllerOptions struct {
 	ExclusionMatcher Matcher
 	SinceStart       bool
 	Since            *time.Time
+	Events           bool
+	IdleTimeout      time.Duration
+	PassMalformed    bool
+
+	// Checkpoints to resume from, keyed by container key. Each is used once.
+	ResumeFrom map[string]*TailerCheckpoint
+
+	// If not zero, the maximum number of log streams open at the same time.
+	// Containers beyond this wait for a slot in order of StreamPriority, and
+	// if StreamRotation is not zero, take turns after this long.
+	MaxStreams     int
+	StreamPriority StreamPriority
+	StreamRotation time.Duration
 }
 
 type (
 	ContainerEnterFunc func(pod *v1.Pod, container *v1.Container, initialAddPhase bool) bool
-	ContainerExitFunc  func(pod *v1.Pod, container *v1.Container)
+	ContainerExitFunc  func(pod *v1.Pod, container *v1.Container, status *ContainerExitStatus)
 	ContainerErrorFunc func(pod *v1.Pod, container *v1.Container, err error)
+	ContainerGapFunc   func(pod *v1.Pod, container *v1.Container, from, to time.Time)
+
+	ContainerMalformedFunc func(pod *v1.Pod, container *v1.Container, line string, count int)
 )
 
 type Callbacks struct {
 	OnEvent             LogEventFunc
 	OnEnter             ContainerEnterFunc
 	OnExit              ContainerExitFunc
+	OnTerminated        ContainerExitFunc
 	OnError             ContainerErrorFunc
+	OnGap               ContainerGapFunc
+	OnMalformed         ContainerMalformedFunc
 	OnNothingDiscovered func()
 }
 
+// TailerInfo describes a tailer that is running, or has been stopped.
+type TailerInfo struct {
+	Namespace string
+	Pod       string
+	Container string
+	Active    bool
+	ContainerTailerStatus
+}
+
+// Number of stopped tailers that are remembered, so that a long session
+// with many short-lived pods doesn't grow without bounds.
+const maxStoppedTailers = 1000
+
 type Controller struct {
 	ControllerOptions
-	client    kubernetes.Interface
-	tailers   map[string]*ContainerTailer
-	callbacks Callbacks
+	client      kubernetes.Interface
+	tailers     map[string]*ContainerTailer
+	stopped     map[string]TailerInfo
+	stoppedKeys []string // Oldest first
+	callbacks   Callbacks
+	podStores   []cache.Store
+	eventsSince *time.Time
+	ctx         context.Context
+	tailersWg   sync.WaitGroup
+	scheduler   *StreamScheduler
 	sync.Mutex
 }
 
 func NewController(client kubernetes.Interface, options ControllerOptions, callbacks Callbacks) *Controller {
-	return &Controller{
+	ctl := &Controller{
 		ControllerOptions: options,
 		client:            client,
 		tailers:           map[string]*ContainerTailer{},
+		stopped:           map[string]TailerInfo{},
 		callbacks:         callbacks,
 	}
+	if options.MaxStreams > 0 {
+		ctl.scheduler = NewStreamScheduler(
+			options.MaxStreams, options.StreamPriority, options.StreamRotation, options.Namespaces)
+	}
+	return ctl
 }
 
+// Run tails containers until the context is cancelled. Before returning, it
+// stops all tailers and waits for them to finish.
 func (ctl *Controller) Run(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
 	stopCh := make(chan struct{})
-	defer close(stopCh)
+	defer func() {
+		cancel()
+		close(stopCh)
+
+		// Tailers are only added while holding the lock and the context is
+		// not cancelled, so no more can be added once the lock is acquired
+		ctl.Lock()
+		for _, tailer := range ctl.tailers {
+			tailer.Stop()
+		}
+		ctl.Unlock()
+		ctl.tailersWg.Wait()
+	}()
+
+	ctl.Lock()
+	ctl.ctx = ctx
+	ctl.Unlock()
+
+	if ctl.scheduler != nil {
+		go ctl.scheduler.Run(ctx)
+	}
+
+	switch {
+	case ctl.SinceStart:
+	case ctl.Since != nil:
+		ctl.eventsSince = ctl.Since
+	default:
+		// Only show events that happen from now on, with the same allowance
+		// for clock skew as for logs
+		now := time.Now().Add(time.Second * -5)
+		ctl.eventsSince = &now
+	}
 
 	discoveredAny := false
 	for _, ns := range ctl.Namespaces {
@@ -86,7 +166,7 @@ func (ctl *Controller) Run(ctx context.Context) error {
 			panic(fmt.Sprintf("unexpected return type %T when listing pods", obj))
 		}
 
-		_, informer := cache.NewIndexerInformer(
+		store, informer := cache.NewIndexerInformer(
 			podListWatcher, &v1.Pod{}, 0, cache.ResourceEventHandlerFuncs{
 				AddFunc: func(obj interface{}) {
 					if pod, ok := obj.(*v1.Pod); ok {
@@ -94,8 +174,10 @@ func (ctl *Controller) Run(ctx context.Context) error {
 					}
 				},
 				UpdateFunc: func(old interface{}, new interface{}) {
-					if pod, ok := new.(*v1.Pod); ok {
-						ctl.onUpdate(pod)
+					oldPod, ok1 := old.(*v1.Pod)
+					newPod, ok2 := new.(*v1.Pod)
+					if ok1 && ok2 {
+						ctl.onUpdate(oldPod, newPod)
 					}
 				},
 				DeleteFunc: func(obj interface{}) {
@@ -106,6 +188,14 @@ func (ctl *Controller) Run(ctx context.Context) error {
 			}, cache.Indexers{})
 
 		go informer.Run(stopCh)
+
+		if ctl.Events {
+			ctl.podStores = append(ctl.podStores, store)
+			if !cache.WaitForCacheSync(stopCh, informer.HasSynced) {
+				return fmt.Errorf("waiting for pods in %q to sync", ns)
+			}
+			ctl.watchEvents(ns, stopCh)
+		}
 	}
 
 	if !discoveredAny {
@@ -146,9 +236,10 @@ func (ctl *Controller) onAdd(pod *v1.Pod) {
 	}
 }
 
-func (ctl *Controller) onUpdate(pod *v1.Pod) {
+func (ctl *Controller) onUpdate(oldPod, pod *v1.Pod) {
 	containers := pod.Spec.Containers
 	containerStatuses := allContainerStatusesForPod(pod)
+	oldContainerStatuses := allContainerStatusesForPod(oldPod)
 	for _, containerStatus := range containerStatuses {
 		var container *v1.Container
 		for i, c := range containers {
@@ -163,6 +254,12 @@ func (ctl *Controller) onUpdate(pod *v1.Pod) {
 			continue
 		}
 
+		for _, oldStatus := range oldContainerStatuses {
+			if oldStatus.Name == containerStatus.Name && containerTerminated(&oldStatus, &containerStatus) {
+				ctl.onContainerTerminated(pod, container)
+			}
+		}
+
 		if ctl.shouldIncludeContainer(pod, container) {
 			ctl.addContainer(pod, container, false)
 		} else {
@@ -194,19 +291,42 @@ func (ctl *Controller) shouldIncludeContainer(pod *v1.Pod, container *v1.Contain
 		return false
 	}
 
+	return ctl.matchesContainer(pod, container)
+}
+
+func (ctl *Controller) matchesContainer(pod *v1.Pod, container *v1.Container) bool {
 	if ctl.ExclusionMatcher.Match(pod) {
 		return false
 	}
-	if !(ctl.InclusionMatcher.Match(pod) || ctl.InclusionMatcher.Match(container)) {
+	if !(ctl.InclusionMatcher.Match(pod) || ctl.InclusionMatcher.Match(container) ||
+		ctl.InclusionMatcher.Match(podContainer{pod, container})) {
 		return false
 	}
 	return !ctl.ExclusionMatcher.Match(container)
 }
 
+func (ctl *Controller) matchesPod(pod *v1.Pod) bool {
+	for i := range pod.Spec.InitContainers {
+		if ctl.matchesContainer(pod, &pod.Spec.InitContainers[i]) {
+			return true
+		}
+	}
+	for i := range pod.Spec.Containers {
+		if ctl.matchesContainer(pod, &pod.Spec.Containers[i]) {
+			return true
+		}
+	}
+	return false
+}
+
 func (ctl *Controller) addContainer(pod *v1.Pod, container *v1.Container, initialAdd bool) {
 	ctl.Lock()
 	defer ctl.Unlock()
 
+	if ctl.ctx.Err() != nil {
+		return
+	}
+
 	key := buildKey(pod, container)
 	if _, ok := ctl.tailers[key]; ok {
 		return
@@ -216,19 +336,42 @@ func (ctl *Controller) addContainer(pod *v1.Pod, container *v1.Container, initia
 		return
 	}
 
-	fromTimestamp, ok := ctl.getStartTimestamp(pod, container, initialAdd)
-	if !ok {
-		return
+	checkpoint := ctl.ResumeFrom[key]
+	delete(ctl.ResumeFrom, key)
+
+	var fromTimestamp *time.Time
+	if checkpoint == nil {
+		var ok bool
+		if fromTimestamp, ok = ctl.getStartTimestamp(pod, container, initialAdd); !ok {
+			return
+		}
 	}
 
 	targetPod, targetContainer := *pod, *container // Copy to avoid mutation
 
-	tailer := NewContainerTailer(ctl.client, targetPod, targetContainer,
-		ctl.callbacks.OnEvent, fromTimestamp)
+	tailer := NewContainerTailer(ctl.ctx, ctl.client, targetPod, targetContainer,
+		ContainerTailerOptions{
+			FromTimestamp: fromTimestamp,
+			IdleTimeout:   ctl.IdleTimeout,
+			PassMalformed: ctl.PassMalformed,
+			Checkpoint:    checkpoint,
+			Scheduler:     ctl.scheduler,
+		},
+		ContainerTailerCallbacks{
+			OnEvent: ctl.callbacks.OnEvent,
+			OnGap: func(from, to time.Time) {
+				ctl.callbacks.OnGap(&targetPod, &targetContainer, from, to)
+			},
+			OnMalformed: func(line string, count int) {
+				ctl.callbacks.OnMalformed(&targetPod, &targetContainer, line, count)
+			},
+		})
 	ctl.tailers[key] = tailer
 
+	ctl.tailersWg.Add(1)
 	go func() {
-		tailer.Run(context.Background(), func(err error) {
+		defer ctl.tailersWg.Done()
+		tailer.Run(func(err error) {
 			ctl.callbacks.OnError(&targetPod, &targetContainer, err)
 		})
 	}()
@@ -242,7 +385,102 @@ func (ctl *Controller) deleteContainer(pod *v1.Pod, container *v1.Container) {
 	if tailer, ok := ctl.tailers[key]; ok {
 		delete(ctl.tailers, key)
 		tailer.Stop()
-		ctl.callbacks.OnExit(pod, container)
+
+		info := newTailerInfo(tailer, false)
+		info.Phase = TailerPhaseStopped
+		if prev, ok := ctl.stopped[key]; ok {
+			info.Reconnects += prev.Reconnects
+			info.Malformed += prev.Malformed
+		}
+		ctl.addStopped(key, info)
+
+		ctl.callbacks.OnExit(pod, container, getContainerExitStatus(pod, container))
+	}
+}
+
+// addStopped remembers a stopped tailer, forgetting the one that was stopped
+// the longest ago when there are too many.
+func (ctl *Controller) addStopped(key string, info TailerInfo) {
+	if _, ok := ctl.stopped[key]; ok {
+		for i, k := range ctl.stoppedKeys {
+			if k == key {
+				ctl.stoppedKeys = append(ctl.stoppedKeys[:i], ctl.stoppedKeys[i+1:]...)
+				break
+			}
+		}
+	}
+	ctl.stopped[key] = info
+	ctl.stoppedKeys = append(ctl.stoppedKeys, key)
+	if len(ctl.stoppedKeys) > maxStoppedTailers {
+		delete(ctl.stopped, ctl.stoppedKeys[0])
+		ctl.stoppedKeys = ctl.stoppedKeys[1:]
+	}
+}
+
+func (ctl *Controller) onContainerTerminated(pod *v1.Pod, container *v1.Container) {
+	ctl.Lock()
+	_, ok := ctl.tailers[buildKey(pod, container)]
+	ctl.Unlock()
+	if ok {
+		ctl.callbacks.OnTerminated(pod, container, getContainerExitStatus(pod, container))
+	}
+}
+
+// Tailers returns information about all tailers, including ones that have
+// been stopped, sorted by key.
+func (ctl *Controller) Tailers() []TailerInfo {
+	ctl.Lock()
+	defer ctl.Unlock()
+
+	keys := make([]string, 0, len(ctl.tailers)+len(ctl.stopped))
+	for key := range ctl.tailers {
+		keys = append(keys, key)
+	}
+	for key := range ctl.stopped {
+		if _, ok := ctl.tailers[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	infos := make([]TailerInfo, 0, len(keys))
+	for _, key := range keys {
+		if tailer, ok := ctl.tailers[key]; ok {
+			info := newTailerInfo(tailer, true)
+			if prev, ok := ctl.stopped[key]; ok {
+				info.Reconnects += prev.Reconnects
+				info.Malformed += prev.Malformed
+			}
+			infos = append(infos, info)
+		} else {
+			infos = append(infos, ctl.stopped[key])
+		}
+	}
+	return infos
+}
+
+// Checkpoints returns the checkpoints of all active tailers, keyed by
+// container key.
+func (ctl *Controller) Checkpoints() map[string]*TailerCheckpoint {
+	ctl.Lock()
+	defer ctl.Unlock()
+
+	checkpoints := make(map[string]*TailerCheckpoint, len(ctl.tailers))
+	for key, tailer := range ctl.tailers {
+		if cp := tailer.Checkpoint(); cp != nil {
+			checkpoints[key] = cp
+		}
+	}
+	return checkpoints
+}
+
+func newTailerInfo(tailer *ContainerTailer, active bool) TailerInfo {
+	return TailerInfo{
+		Namespace:             tailer.pod.Namespace,
+		Pod:                   tailer.pod.Name,
+		Container:             tailer.container.Name,
+		Active:                active,
+		ContainerTailerStatus: tailer.Status(),
 	}
 }
 
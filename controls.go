@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fatih/color"
+)
+
+// maxPauseBuffer is the maximum number of lines kept while output is paused.
+// Beyond this, the oldest lines are dropped.
+const maxPauseBuffer = 10000
+
+// streamToggle is a setting that can be switched on and off with a key.
+type streamToggle struct {
+	key    rune
+	name   string
+	toggle func() bool
+}
+
+type streamEntry struct {
+	event  *LogEvent
+	marker string
+}
+
+// StreamControls lets the normal output be controlled with single key
+// presses: pausing, inserting markers, toggling settings, clearing the
+// screen and listing containers.
+type StreamControls struct {
+	write        func(*LogEvent)
+	out          io.Writer
+	outLock      sync.Locker
+	toggles      []streamToggle
+	printTailers func()
+	paused       bool
+	buffer       []streamEntry
+	dropped      int
+	sync.Mutex
+}
+
+func NewStreamControls(
+	write func(*LogEvent),
+	out io.Writer,
+	outLock sync.Locker,
+	toggles []streamToggle,
+	printTailers func()) *StreamControls {
+	return &StreamControls{
+		write:        write,
+		out:          out,
+		outLock:      outLock,
+		toggles:      toggles,
+		printTailers: printTailers,
+	}
+}
+
+func (sc *StreamControls) Write(event *LogEvent) {
+	sc.Lock()
+	defer sc.Unlock()
+	if sc.paused {
+		sc.bufferEntry(streamEntry{event: event})
+		return
+	}
+	sc.write(event)
+}
+
+// Run handles key presses until the context is cancelled. 'q' calls quit.
+func (sc *StreamControls) Run(ctx context.Context, keys <-chan keyPress, quit func()) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case key, ok := <-keys:
+			if !ok {
+				return
+			}
+			switch {
+			case key.r == 'q':
+				quit()
+				return
+			case key.r == ' ', key.r == 'p':
+				sc.togglePause()
+			case key.r == 'm', key.name == "enter":
+				sc.mark()
+			case key.r == 'c':
+				sc.outLock.Lock()
+				_, _ = io.WriteString(sc.out, "\x1b[H\x1b[2J")
+				sc.outLock.Unlock()
+			case key.r == 'l':
+				sc.printTailers()
+			case key.r == '?', key.r == 'h':
+				sc.printHelp()
+			default:
+				for _, t := range sc.toggles {
+					if t.key == key.r {
+						sc.outLock.Lock()
+						on := t.toggle()
+						sc.outLock.Unlock()
+						state := "off"
+						if on {
+							state = "on"
+						}
+						printInfo("%s %s", t.name, state)
+						break
+					}
+				}
+			}
+		}
+	}
+}
+
+func (sc *StreamControls) togglePause() {
+	sc.Lock()
+	defer sc.Unlock()
+
+	if !sc.paused {
+		sc.paused = true
+		printInfo("Output paused; press space to resume")
+		return
+	}
+
+	sc.paused = false
+	msg := fmt.Sprintf("Output resumed; %d lines were buffered", len(sc.buffer))
+	if sc.dropped > 0 {
+		msg += fmt.Sprintf(", %d older lines were dropped", sc.dropped)
+	}
+	printInfo("%s", msg)
+	for _, entry := range sc.buffer {
+		if entry.event != nil {
+			sc.write(entry.event)
+		} else {
+			sc.writeMarker(entry.marker)
+		}
+	}
+	sc.buffer = nil
+	sc.dropped = 0
+}
+
+func (sc *StreamControls) mark() {
+	sc.Lock()
+	defer sc.Unlock()
+
+	marker := fmt.Sprintf("──── %s ────", time.Now().Format(time.RFC3339))
+	if sc.paused {
+		sc.bufferEntry(streamEntry{marker: marker})
+		return
+	}
+	sc.writeMarker(marker)
+}
+
+func (sc *StreamControls) writeMarker(marker string) {
+	sc.outLock.Lock()
+	defer sc.outLock.Unlock()
+	_, _ = fmt.Fprintln(sc.out, color.New(color.Bold).Sprint(marker))
+}
+
+func (sc *StreamControls) bufferEntry(entry streamEntry) {
+	if len(sc.buffer) >= maxPauseBuffer {
+		sc.buffer = sc.buffer[1:]
+		sc.dropped++
+	}
+	sc.buffer = append(sc.buffer, entry)
+}
+
+func (sc *StreamControls) printHelp() {
+	var sb strings.Builder
+	sb.WriteString("Keys: space pause/resume, m mark, c clear screen, l list containers, ")
+	for _, t := range sc.toggles {
+		_, _ = fmt.Fprintf(&sb, "%c toggle %s, ", t.key, strings.ToLower(t.name))
+	}
+	sb.WriteString("q quit")
+	printInfo("%s", sb.String())
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"strings"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/client-go/tools/cache"
+)
+
+func (ctl *Controller) watchEvents(ns string, stopCh <-chan struct{}) {
+	eventListWatcher := cache.NewListWatchFromClient(
+		ctl.client.CoreV1().RESTClient(), "events", ns,
+		fields.OneTermEqualSelector("involvedObject.kind", "Pod"))
+
+	_, informer := cache.NewIndexerInformer(
+		eventListWatcher, &v1.Event{}, 0, cache.ResourceEventHandlerFuncs{
+			AddFunc: func(obj interface{}) {
+				if event, ok := obj.(*v1.Event); ok {
+					ctl.onKubeEvent(event)
+				}
+			},
+			UpdateFunc: func(old interface{}, new interface{}) {
+				oldEvent, ok1 := old.(*v1.Event)
+				newEvent, ok2 := new.(*v1.Event)
+				if ok1 && ok2 && oldEvent.ResourceVersion != newEvent.ResourceVersion {
+					ctl.onKubeEvent(newEvent)
+				}
+			},
+		}, cache.Indexers{})
+
+	go informer.Run(stopCh)
+}
+
+func (ctl *Controller) onKubeEvent(event *v1.Event) {
+	timestamp := kubeEventTimestamp(event)
+	if ctl.eventsSince != nil && timestamp.Before(*ctl.eventsSince) {
+		return
+	}
+
+	pod := ctl.findPod(event.InvolvedObject.Namespace, event.InvolvedObject.Name)
+	if pod == nil || pod.UID != event.InvolvedObject.UID {
+		return
+	}
+
+	container := findContainerByFieldPath(pod, event.InvolvedObject.FieldPath)
+	if container != nil {
+		if !ctl.matchesContainer(pod, container) {
+			return
+		}
+	} else if !ctl.matchesPod(pod) {
+		return
+	}
+
+	ctl.callbacks.OnEvent(LogEvent{
+		Kind:      LogEventKindEvent,
+		Pod:       pod,
+		Container: container,
+		Timestamp: &timestamp,
+		Message:   strings.TrimSpace(event.Message),
+		Event:     event,
+	})
+}
+
+func (ctl *Controller) findPod(namespace, name string) *v1.Pod {
+	for _, store := range ctl.podStores {
+		obj, exists, err := store.GetByKey(namespace + "/" + name)
+		if err != nil || !exists {
+			continue
+		}
+		if pod, ok := obj.(*v1.Pod); ok {
+			return pod
+		}
+	}
+	return nil
+}
+
+// findContainerByFieldPath resolves an event's field path, such as
+// "spec.containers{app}", to the container it refers to.
+func findContainerByFieldPath(pod *v1.Pod, fieldPath string) *v1.Container {
+	var containers []v1.Container
+	switch {
+	case strings.HasPrefix(fieldPath, "spec.containers{"):
+		containers = pod.Spec.Containers
+	case strings.HasPrefix(fieldPath, "spec.initContainers{"):
+		containers = pod.Spec.InitContainers
+	default:
+		return nil
+	}
+
+	start, end := strings.IndexByte(fieldPath, '{'), strings.IndexByte(fieldPath, '}')
+	if end < start {
+		return nil
+	}
+	name := fieldPath[start+1 : end]
+	for i := range containers {
+		if containers[i].Name == name {
+			container := containers[i]
+			return &container
+		}
+	}
+	return nil
+}
+
+func kubeEventTimestamp(event *v1.Event) time.Time {
+	switch {
+	case event.Series != nil && !event.Series.LastObservedTime.IsZero():
+		return event.Series.LastObservedTime.Time
+	case !event.LastTimestamp.IsZero():
+		return event.LastTimestamp.Time
+	case !event.EventTime.IsZero():
+		return event.EventTime.Time
+	default:
+		return event.CreationTimestamp.Time
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"testing"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func newTestPod(namespace, name string) *v1.Pod {
+	return &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: namespace,
+			Name:      name,
+			UID:       types.UID("uid-" + name),
+			Labels:    map[string]string{"app": name},
+		},
+		Spec: v1.PodSpec{
+			NodeName:   "node-1",
+			Containers: []v1.Container{{Name: "app"}},
+		},
+	}
+}
+
+func newTestLogEvent(pod *v1.Pod, timestamp time.Time, message string) *LogEvent {
+	return &LogEvent{
+		Kind:      LogEventKindLog,
+		Pod:       pod,
+		Container: &pod.Spec.Containers[0],
+		Timestamp: &timestamp,
+		Message:   message,
+	}
+}
+
+// captureMessages collects the messages printed during a test.
+func captureMessages(t *testing.T) *bytes.Buffer {
+	var buf bytes.Buffer
+	setMessageOutput(&buf)
+	t.Cleanup(func() {
+		setMessageOutput(os.Stderr)
+	})
+	return &buf
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+// How long to wait for a hook command's output to be closed after it has
+// exited or been killed.
+const hookWaitDelay = 5 * time.Second
+
+type HookTrigger string
+
+const (
+	HookTriggerEnter HookTrigger = "enter"
+	HookTriggerExit  HookTrigger = "exit"
+	HookTriggerError HookTrigger = "error"
+	HookTriggerMatch HookTrigger = "match"
+)
+
+// Hook is an external command that is run when something happens to a
+// container. The command is run with "sh -c".
+type Hook struct {
+	Trigger HookTrigger
+	Command string
+	Pattern *regexp.Regexp // Only used for HookTriggerMatch
+	Timeout time.Duration
+}
+
+func parseHookTrigger(s string) (HookTrigger, error) {
+	switch t := HookTrigger(s); t {
+	case HookTriggerEnter, HookTriggerExit, HookTriggerError, HookTriggerMatch:
+		return t, nil
+	}
+	return "", fmt.Errorf("invalid hook trigger %q (must be one of enter, exit, error, match)", s)
+}
+
+func buildHooks(configs []HookConfig, defaultTimeout time.Duration) ([]Hook, error) {
+	hooks := make([]Hook, 0, len(configs))
+	for _, c := range configs {
+		trigger, err := parseHookTrigger(c.On)
+		if err != nil {
+			return nil, err
+		}
+		if c.Command == "" {
+			return nil, fmt.Errorf("%s hook has no command", trigger)
+		}
+		hook := Hook{
+			Trigger: trigger,
+			Command: c.Command,
+			Timeout: time.Duration(c.Timeout),
+		}
+		if hook.Timeout <= 0 {
+			hook.Timeout = defaultTimeout
+		}
+		if trigger == HookTriggerMatch {
+			if c.Pattern == "" {
+				return nil, fmt.Errorf("match hook %q has no pattern", c.Command)
+			}
+			if hook.Pattern, err = regexp.Compile(c.Pattern); err != nil {
+				return nil, fmt.Errorf("invalid hook pattern %q: %w", c.Pattern, err)
+			}
+		}
+		hooks = append(hooks, hook)
+	}
+	return hooks, nil
+}
+
+// hookPayload is passed as JSON to the hook command's standard input.
+type hookPayload struct {
+	Hook      HookTrigger          `json:"hook"`
+	Timestamp time.Time            `json:"timestamp"`
+	Namespace string               `json:"namespace"`
+	Pod       string               `json:"pod"`
+	Container string               `json:"container"`
+	Node      string               `json:"node,omitempty"`
+	Labels    map[string]string    `json:"labels,omitempty"`
+	Message   string               `json:"message,omitempty"`
+	Error     string               `json:"error,omitempty"`
+	Exit      *ContainerExitStatus `json:"exit,omitempty"`
+}
+
+type hookJob struct {
+	hook    *Hook
+	payload *hookPayload
+}
+
+// HookRunner runs hooks in the background using a fixed number of workers.
+// If all workers are busy and the queue is full, new invocations are
+// dropped rather than blocking the caller.
+type HookRunner struct {
+	hooks       []Hook
+	concurrency int
+	queue       chan hookJob
+	dropped     int64
+	reported    time.Time
+	sync.Mutex
+}
+
+func NewHookRunner(hooks []Hook, concurrency int) *HookRunner {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	return &HookRunner{
+		hooks:       hooks,
+		concurrency: concurrency,
+		queue:       make(chan hookJob, concurrency*16),
+	}
+}
+
+// Run starts the workers. It returns immediately; workers exit when the
+// context is cancelled.
+func (hr *HookRunner) Run(ctx context.Context) {
+	for i := 0; i < hr.concurrency; i++ {
+		go func() {
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case job := <-hr.queue:
+					hr.execute(ctx, job)
+				}
+			}
+		}()
+	}
+}
+
+func (hr *HookRunner) OnEnter(pod *v1.Pod, container *v1.Container) {
+	hr.trigger(HookTriggerEnter, newHookPayload(pod, container))
+}
+
+func (hr *HookRunner) OnExit(pod *v1.Pod, container *v1.Container, status *ContainerExitStatus) {
+	payload := newHookPayload(pod, container)
+	payload.Exit = status
+	hr.trigger(HookTriggerExit, payload)
+}
+
+func (hr *HookRunner) OnError(pod *v1.Pod, container *v1.Container, err error) {
+	payload := newHookPayload(pod, container)
+	payload.Error = err.Error()
+	hr.trigger(HookTriggerError, payload)
+}
+
+func (hr *HookRunner) OnEvent(event *LogEvent) {
+	if event.Kind != LogEventKindLog {
+		return
+	}
+	for i := range hr.hooks {
+		hook := &hr.hooks[i]
+		if hook.Trigger != HookTriggerMatch || !hook.Pattern.MatchString(event.Message) {
+			continue
+		}
+		payload := newHookPayload(event.Pod, event.Container)
+		payload.Timestamp = *event.Timestamp
+		payload.Message = event.Message
+		hr.enqueue(hook, payload)
+	}
+}
+
+func (hr *HookRunner) trigger(trigger HookTrigger, payload *hookPayload) {
+	for i := range hr.hooks {
+		if hook := &hr.hooks[i]; hook.Trigger == trigger {
+			hr.enqueue(hook, payload)
+		}
+	}
+}
+
+func (hr *HookRunner) enqueue(hook *Hook, payload *hookPayload) {
+	p := *payload
+	p.Hook = hook.Trigger
+	select {
+	case hr.queue <- hookJob{hook: hook, payload: &p}:
+	default:
+		// A flood of matching lines must not become a flood of errors
+		hr.Lock()
+		defer hr.Unlock()
+		hr.dropped++
+		if time.Since(hr.reported) >= 10*time.Second {
+			printError("Too many hooks running; skipped %d hooks", hr.dropped)
+			hr.dropped = 0
+			hr.reported = time.Now()
+		}
+	}
+}
+
+func (hr *HookRunner) execute(ctx context.Context, job hookJob) {
+	input, err := json.Marshal(job.payload)
+	if err != nil {
+		printError("Could not encode hook payload: %s", err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, job.hook.Timeout)
+	defer cancel()
+
+	var output bytes.Buffer
+	cmd := exec.CommandContext(ctx, "sh", "-c", job.hook.Command)
+	cmd.Stdin = bytes.NewReader(input)
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	cmd.Env = append(os.Environ(), job.payload.environ()...)
+	killProcessGroup(cmd)
+	// Don't wait forever for processes left behind by the command that still
+	// hold on to its output
+	cmd.WaitDelay = hookWaitDelay
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			err = fmt.Errorf("timed out after %s", job.hook.Timeout)
+		}
+		msg := fmt.Sprintf("Hook %q failed: %s", job.hook.Command, err)
+		if out := strings.TrimSpace(output.String()); out != "" {
+			msg += ": " + out
+		}
+		printError("%s", msg)
+	}
+}
+
+func newHookPayload(pod *v1.Pod, container *v1.Container) *hookPayload {
+	return &hookPayload{
+		Timestamp: time.Now(),
+		Namespace: pod.Namespace,
+		Pod:       pod.Name,
+		Container: container.Name,
+		Node:      pod.Spec.NodeName,
+		Labels:    pod.Labels,
+	}
+}
+
+func (p *hookPayload) environ() []string {
+	env := []string{
+		"KTAIL_HOOK=" + string(p.Hook),
+		"KTAIL_NAMESPACE=" + p.Namespace,
+		"KTAIL_POD=" + p.Pod,
+		"KTAIL_CONTAINER=" + p.Container,
+		"KTAIL_NODE=" + p.Node,
+	}
+	if p.Message != "" {
+		env = append(env, "KTAIL_MESSAGE="+p.Message)
+	}
+	if p.Error != "" {
+		env = append(env, "KTAIL_ERROR="+p.Error)
+	}
+	if p.Exit != nil {
+		env = append(env, "KTAIL_STATE="+p.Exit.State, "KTAIL_REASON="+p.Exit.Reason,
+			"KTAIL_RESTART_COUNT="+strconv.Itoa(int(p.Exit.RestartCount)))
+		termination := p.Exit.Termination
+		if termination == nil {
+			termination = p.Exit.LastTermination
+		}
+		if termination != nil {
+			env = append(env, "KTAIL_EXIT_CODE="+strconv.Itoa(int(termination.ExitCode)))
+		}
+	}
+	return env
+}
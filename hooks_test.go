@@ -0,0 +1,97 @@
+//go:build !windows
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHookRunnerDropsWhenQueueIsFull(t *testing.T) {
+	messages := captureMessages(t)
+	hooks := []Hook{{Trigger: HookTriggerEnter, Command: "true", Timeout: time.Second}}
+	// The workers aren't started, so nothing is taken off the queue
+	hr := NewHookRunner(hooks, 1)
+
+	pod := newTestPod("default", "web")
+	for i := 0; i < cap(hr.queue)+5; i++ {
+		hr.OnEnter(pod, &pod.Spec.Containers[0])
+	}
+
+	if n := len(hr.queue); n != cap(hr.queue) {
+		t.Errorf("got %d queued hooks, want %d", n, cap(hr.queue))
+	}
+	// The first drop is reported, and the rest wait for the next report
+	if got := strings.Count(messages.String(), "skipped 1 hooks"); got != 1 {
+		t.Errorf("got messages %q", messages.String())
+	}
+	if hr.dropped != 4 {
+		t.Errorf("got %d unreported drops", hr.dropped)
+	}
+}
+
+func TestHookRunnerPassesPayload(t *testing.T) {
+	captureMessages(t)
+	dir := t.TempDir()
+	hooks := []Hook{{
+		Trigger: HookTriggerExit,
+		Command: `cat > ` + dir + `/input; echo "$KTAIL_POD $KTAIL_EXIT_CODE" > ` + dir + `/env`,
+		Timeout: 5 * time.Second,
+	}}
+	hr := NewHookRunner(hooks, 1)
+
+	pod := newTestPod("default", "web")
+	hr.OnExit(pod, &pod.Spec.Containers[0], &ContainerExitStatus{
+		State:       "terminated",
+		Termination: &ContainerTermination{ExitCode: 3},
+	})
+	hr.execute(context.Background(), <-hr.queue)
+
+	input, err := os.ReadFile(filepath.Join(dir, "input"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	env, err := os.ReadFile(filepath.Join(dir, "env"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var payload hookPayload
+	if err := json.Unmarshal(input, &payload); err != nil {
+		t.Fatalf("invalid payload %q: %s", input, err)
+	}
+	if payload.Hook != HookTriggerExit || payload.Namespace != "default" || payload.Pod != "web" ||
+		payload.Container != "app" || payload.Exit == nil || payload.Exit.Termination.ExitCode != 3 {
+		t.Errorf("unexpected payload: %+v", payload)
+	}
+	if strings.TrimSpace(string(env)) != "web 3" {
+		t.Errorf("got environment %q", env)
+	}
+}
+
+func TestHookRunnerKillsProcessGroupOnTimeout(t *testing.T) {
+	messages := captureMessages(t)
+	hooks := []Hook{{
+		Trigger: HookTriggerEnter,
+		// The child keeps the output open, so the hook can only finish
+		// early if the child is killed along with the shell
+		Command: `sleep 30 & wait`,
+		Timeout: 200 * time.Millisecond,
+	}}
+	hr := NewHookRunner(hooks, 1)
+
+	pod := newTestPod("default", "web")
+	hr.OnEnter(pod, &pod.Spec.Containers[0])
+	start := time.Now()
+	hr.execute(context.Background(), <-hr.queue)
+	if elapsed := time.Since(start); elapsed >= hookWaitDelay {
+		t.Errorf("hook took %s", elapsed)
+	}
+	if !strings.Contains(messages.String(), "timed out after 200ms") {
+		t.Errorf("got messages %q", messages.String())
+	}
+}
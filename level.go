@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"regexp"
+	"strings"
+)
+
+type LogLevel int
+
+const (
+	LogLevelUnknown LogLevel = iota
+	LogLevelTrace
+	LogLevelDebug
+	LogLevelInfo
+	LogLevelWarn
+	LogLevelError
+	LogLevelFatal
+)
+
+var logLevelNames = map[LogLevel]string{
+	LogLevelUnknown: "unknown",
+	LogLevelTrace:   "trace",
+	LogLevelDebug:   "debug",
+	LogLevelInfo:    "info",
+	LogLevelWarn:    "warn",
+	LogLevelError:   "error",
+	LogLevelFatal:   "fatal",
+}
+
+func (l LogLevel) String() string {
+	return logLevelNames[l]
+}
+
+func (l LogLevel) MarshalText() ([]byte, error) {
+	return []byte(l.String()), nil
+}
+
+// parseLogLevel parses a level name such as "warn", "WARNING" or "E".
+func parseLogLevel(s string) LogLevel {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "trace", "trc", "t":
+		return LogLevelTrace
+	case "debug", "dbg", "d":
+		return LogLevelDebug
+	case "info", "inf", "i", "information", "notice":
+		return LogLevelInfo
+	case "warn", "warning", "wrn", "w":
+		return LogLevelWarn
+	case "error", "err", "e":
+		return LogLevelError
+	case "fatal", "critical", "crit", "panic", "emerg", "emergency", "alert", "f":
+		return LogLevelFatal
+	}
+	return LogLevelUnknown
+}
+
+var (
+	jsonLevelKeys   = []string{"level", "lvl", "severity", "loglevel", "log.level"}
+	logfmtLevelExpr = regexp.MustCompile(`(?i)\b(?:level|lvl|severity)=["']?(\w+)`)
+	plainLevelExpr  = regexp.MustCompile(
+		`\b(TRACE|DEBUG|INFO|NOTICE|WARN|WARNING|ERROR|ERR|FATAL|CRITICAL|PANIC)\b|^([IWEF])\d{4} `)
+)
+
+// Level returns the level of the message, detecting it the first time it is
+// needed.
+func (e *LogEvent) Level() LogLevel {
+	if !e.levelDetected {
+		e.level, e.levelDetected = detectLogLevel(e.Message), true
+	}
+	return e.level
+}
+
+// detectLogLevel guesses the level of a log message. It understands JSON
+// messages with a level field, logfmt-style "level=" pairs, klog-style
+// prefixes such as "E0102", and upper-case level names in plain text.
+func detectLogLevel(message string) LogLevel {
+	if len(message) >= 2 && message[0] == '{' && message[len(message)-1] == '}' {
+		var fields map[string]interface{}
+		if err := json.Unmarshal([]byte(message), &fields); err == nil {
+			for _, key := range jsonLevelKeys {
+				if s, ok := fields[key].(string); ok {
+					if level := parseLogLevel(s); level != LogLevelUnknown {
+						return level
+					}
+				}
+			}
+			return LogLevelUnknown
+		}
+	}
+	if m := logfmtLevelExpr.FindStringSubmatch(message); m != nil {
+		if level := parseLogLevel(m[1]); level != LogLevelUnknown {
+			return level
+		}
+	}
+	if m := plainLevelExpr.FindStringSubmatch(message); m != nil {
+		if m[1] != "" {
+			return parseLogLevel(m[1])
+		}
+		return parseLogLevel(m[2])
+	}
+	return LogLevelUnknown
+}
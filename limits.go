@@ -0,0 +1,261 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand/v2"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LimitRule limits the number of lines output from containers. Lines are
+// first sampled, and the lines that remain are then rate limited.
+type LimitRule struct {
+	Pattern *regexp.Regexp // Matched against pod and container names; nil matches all
+	Rate    float64        // Lines per second; 0 means no limit
+	Burst   int            // Lines allowed in a burst above Rate
+	Sample  float64        // Fraction of lines to keep, chosen at random; 0 means all
+	Every   int            // Keep only every Nth line; 0 means all
+}
+
+func (r *LimitRule) limited() bool {
+	return r.Rate > 0 || (r.Sample > 0 && r.Sample < 1) || r.Every > 1
+}
+
+func (r *LimitRule) String() string {
+	var parts []string
+	if r.Every > 1 {
+		parts = append(parts, fmt.Sprintf("1 in %d", r.Every))
+	}
+	if r.Sample > 0 && r.Sample < 1 {
+		parts = append(parts, fmt.Sprintf("%g%% sampled", r.Sample*100))
+	}
+	if r.Rate > 0 {
+		parts = append(parts, fmt.Sprintf("%g lines/s", r.Rate))
+	}
+	return strings.Join(parts, ", ")
+}
+
+func buildLimitRules(configs []LimitConfig) ([]LimitRule, error) {
+	rules := make([]LimitRule, 0, len(configs))
+	for _, c := range configs {
+		if c.Pattern == "" {
+			return nil, fmt.Errorf("limit has no pattern")
+		}
+		rule, err := newLimitRule(c.Rate, c.Burst, c.Sample, c.Every)
+		if err != nil {
+			return nil, fmt.Errorf("invalid limit for %q: %w", c.Pattern, err)
+		}
+		if rule.Pattern, err = regexp.Compile(c.Pattern); err != nil {
+			return nil, fmt.Errorf("invalid limit pattern %q: %w", c.Pattern, err)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+func newLimitRule(rate float64, burst int, sample float64, every int) (LimitRule, error) {
+	if rate < 0 || burst < 0 || every < 0 {
+		return LimitRule{}, fmt.Errorf("rate, burst and every must not be negative")
+	}
+	if sample < 0 || sample > 1 {
+		return LimitRule{}, fmt.Errorf("sample must be between 0 and 1")
+	}
+	if burst == 0 {
+		burst = max(1, int(rate))
+	}
+	return LimitRule{Rate: rate, Burst: burst, Sample: sample, Every: every}, nil
+}
+
+// parseLimitSpec parses a limit given on the command line, such as
+// "istio-proxy=sample=1%" or "api=rate=100,burst=200".
+func parseLimitSpec(s string) (LimitConfig, error) {
+	pattern, spec, ok := strings.Cut(s, "=")
+	if !ok || pattern == "" || spec == "" {
+		return LimitConfig{}, fmt.Errorf("invalid limit %q: must be PATTERN=SPEC", s)
+	}
+	c := LimitConfig{Pattern: pattern}
+	for _, field := range strings.Split(spec, ",") {
+		key, value, ok := strings.Cut(strings.TrimSpace(field), "=")
+		if !ok {
+			return LimitConfig{}, fmt.Errorf("invalid limit %q: expected KEY=VALUE, got %q", s, field)
+		}
+		var err error
+		switch key {
+		case "rate":
+			c.Rate, err = strconv.ParseFloat(value, 64)
+		case "burst":
+			c.Burst, err = strconv.Atoi(value)
+		case "every":
+			c.Every, err = strconv.Atoi(value)
+		case "sample":
+			c.Sample, err = parseFraction(value)
+		default:
+			return LimitConfig{}, fmt.Errorf(
+				"invalid limit %q: unknown key %q (must be one of rate, burst, sample, every)", s, key)
+		}
+		if err != nil {
+			return LimitConfig{}, fmt.Errorf("invalid limit %q: invalid %s %q", s, key, value)
+		}
+	}
+	return c, nil
+}
+
+// parseFraction parses a fraction such as "0.01" or "1%".
+func parseFraction(s string) (float64, error) {
+	if p, ok := strings.CutSuffix(s, "%"); ok {
+		f, err := strconv.ParseFloat(p, 64)
+		return f / 100, err
+	}
+	return strconv.ParseFloat(s, 64)
+}
+
+type containerLimit struct {
+	rule       *LimitRule
+	namespace  string
+	pod        string
+	container  string
+	tokens     float64
+	last       time.Time
+	count      int
+	suppressed int64
+	lastSeen   time.Time
+}
+
+// Limiter applies limit rules to the lines of each container, and
+// periodically reports how many lines were suppressed.
+type Limiter struct {
+	rules       []LimitRule
+	defaultRule LimitRule
+	containers  map[string]*containerLimit
+	formatName  func(namespace, pod, container string) string
+	sync.Mutex
+}
+
+// NewLimiter creates a limiter. The first rule matching a container
+// applies; containers that don't match any rule get defaultRule.
+func NewLimiter(
+	rules []LimitRule,
+	defaultRule LimitRule,
+	formatName func(namespace, pod, container string) string) *Limiter {
+	return &Limiter{
+		rules:       rules,
+		defaultRule: defaultRule,
+		containers:  map[string]*containerLimit{},
+		formatName:  formatName,
+	}
+}
+
+// Allow returns whether an event should be output. Only log lines are
+// limited.
+func (l *Limiter) Allow(event *LogEvent) bool {
+	if event.Kind != LogEventKindLog {
+		return true
+	}
+
+	l.Lock()
+	defer l.Unlock()
+
+	now := time.Now()
+	cl := l.getContainer(event)
+	cl.lastSeen = now
+	if cl.rule == nil {
+		return true
+	}
+	rule := cl.rule
+
+	if rule.Every > 1 {
+		cl.count++
+		if cl.count%rule.Every != 1 {
+			cl.suppressed++
+			return false
+		}
+	}
+	if rule.Sample > 0 && rule.Sample < 1 && rand.Float64() >= rule.Sample {
+		cl.suppressed++
+		return false
+	}
+	if rule.Rate > 0 {
+		cl.tokens = min(float64(rule.Burst), cl.tokens+now.Sub(cl.last).Seconds()*rule.Rate)
+		cl.last = now
+		if cl.tokens < 1 {
+			cl.suppressed++
+			return false
+		}
+		cl.tokens--
+	}
+	return true
+}
+
+func (l *Limiter) getContainer(event *LogEvent) *containerLimit {
+	key := logEventKey(event)
+	if cl, ok := l.containers[key]; ok {
+		return cl
+	}
+
+	cl := &containerLimit{
+		namespace: event.Pod.Namespace,
+		pod:       event.Pod.Name,
+		container: event.Container.Name,
+		last:      time.Now(),
+	}
+	rule := &l.defaultRule
+	for i := range l.rules {
+		r := &l.rules[i]
+		if r.Pattern.MatchString(event.Pod.Name) || r.Pattern.MatchString(event.Container.Name) {
+			rule = r
+			break
+		}
+	}
+	if rule.limited() {
+		cl.rule = rule
+		cl.tokens = float64(rule.Burst)
+	}
+	l.containers[key] = cl
+	return cl
+}
+
+// Run periodically reports suppressed lines until the context is cancelled.
+func (l *Limiter) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			l.Flush()
+		}
+	}
+}
+
+// Flush reports any lines suppressed since the last report.
+func (l *Limiter) Flush() {
+	l.Lock()
+	defer l.Unlock()
+
+	keys := make([]string, 0, len(l.containers))
+	for key, cl := range l.containers {
+		if cl.suppressed == 0 && time.Since(cl.lastSeen) > 10*time.Minute {
+			// Forget containers that have gone quiet, which have probably left
+			delete(l.containers, key)
+			continue
+		}
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		cl := l.containers[key]
+		if cl.suppressed == 0 {
+			continue
+		}
+		printInfo("Suppressed %d lines from %s (%s)",
+			cl.suppressed, l.formatName(cl.namespace, cl.pod, cl.container), cl.rule)
+		cl.suppressed = 0
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const lokiPushPath = "/loki/api/v1/push"
+
+// LokiSinkOptions configures a LokiSink.
+type LokiSinkOptions struct {
+	// Base URL of Loki, or the full URL of the push endpoint.
+	URL string
+
+	// Sent as X-Scope-OrgID, if not empty.
+	Tenant string
+
+	// Pod labels to add to the stream labels, in addition to namespace, pod
+	// and container.
+	Labels []string
+
+	// Maximum number of lines to push at once, and how long to wait for a
+	// batch to fill up.
+	BatchSize int
+	BatchWait time.Duration
+
+	// Maximum number of lines waiting to be pushed.
+	BufferSize int
+}
+
+// LokiSink pushes log lines to Grafana Loki.
+type LokiSink struct {
+	options LokiSinkOptions
+	client  *http.Client
+	queue   *sinkQueue
+	ctx     context.Context
+	cancel  context.CancelFunc
+	done    chan struct{}
+}
+
+func NewLokiSink(options LokiSinkOptions, client *http.Client) (*LokiSink, error) {
+	u, err := url.Parse(options.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid Loki URL %q", options.URL)
+	}
+	if u.Path == "" || u.Path == "/" {
+		u.Path = lokiPushPath
+	}
+	options.URL = u.String()
+	options.BatchSize = max(1, options.BatchSize)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	return &LokiSink{
+		options: options,
+		client:  client,
+		queue:   newSinkQueue("Loki", max(options.BatchSize, options.BufferSize)),
+		ctx:     ctx,
+		cancel:  cancel,
+		done:    make(chan struct{}),
+	}, nil
+}
+
+func (s *LokiSink) OnEvent(event *LogEvent) {
+	if event.Kind != LogEventKindLog {
+		return
+	}
+	s.queue.Add(*event)
+}
+
+// Run pushes batches of lines until the sink is closed.
+func (s *LokiSink) Run() {
+	defer close(s.done)
+	for {
+		batch, ok := s.queue.Next(s.options.BatchSize, s.options.BatchWait)
+		if !ok {
+			return
+		}
+		s.push(batch)
+	}
+}
+
+// Close pushes the lines that are still queued, giving up after a while if
+// Loki can't be reached.
+func (s *LokiSink) Close() {
+	s.queue.Close()
+	select {
+	case <-s.done:
+	case <-time.After(10 * time.Second):
+		s.cancel()
+		<-s.done
+	}
+	s.cancel()
+}
+
+func (s *LokiSink) push(batch []LogEvent) {
+	body, err := json.Marshal(s.buildRequest(batch))
+	if err != nil {
+		printError("Could not push %d lines to Loki: %s", len(batch), err)
+		return
+	}
+	headers := map[string]string{}
+	if s.options.Tenant != "" {
+		headers["X-Scope-OrgID"] = s.options.Tenant
+	}
+	if err := postWithRetry(s.ctx, s.client, s.options.URL, headers, body); err != nil {
+		printError("Could not push %d lines to Loki: %s", len(batch), err)
+	}
+}
+
+type lokiPushRequest struct {
+	Streams []*lokiStream `json:"streams"`
+}
+
+type lokiStream struct {
+	Stream map[string]string `json:"stream"`
+	Values [][2]string       `json:"values"`
+}
+
+func (s *LokiSink) buildRequest(batch []LogEvent) *lokiPushRequest {
+	now := time.Now()
+	timestamp := func(event *LogEvent) time.Time {
+		if event.Timestamp != nil {
+			return *event.Timestamp
+		}
+		return now
+	}
+
+	// Older versions of Loki reject lines that are out of order
+	sort.SliceStable(batch, func(i, j int) bool {
+		return timestamp(&batch[i]).Before(timestamp(&batch[j]))
+	})
+
+	req := &lokiPushRequest{}
+	streams := map[string]*lokiStream{}
+	for i := range batch {
+		event := &batch[i]
+		labels := s.streamLabels(event)
+		key := buildLokiStreamKey(labels)
+		stream, ok := streams[key]
+		if !ok {
+			stream = &lokiStream{Stream: labels}
+			streams[key] = stream
+			req.Streams = append(req.Streams, stream)
+		}
+		stream.Values = append(stream.Values,
+			[2]string{strconv.FormatInt(timestamp(event).UnixNano(), 10), event.Message})
+	}
+	return req
+}
+
+func (s *LokiSink) streamLabels(event *LogEvent) map[string]string {
+	labels := map[string]string{}
+	for _, name := range s.options.Labels {
+		if value, ok := event.Pod.Labels[name]; ok {
+			labels[lokiLabelName(name)] = value
+		}
+	}
+	// Last, so that pod labels with the same names can't replace them
+	labels["namespace"] = event.Pod.Namespace
+	labels["pod"] = event.Pod.Name
+	if event.Container != nil {
+		labels["container"] = event.Container.Name
+	}
+	return labels
+}
+
+func buildLokiStreamKey(labels map[string]string) string {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var b strings.Builder
+	for _, name := range names {
+		b.WriteString(name + "\xff" + labels[name] + "\xff")
+	}
+	return b.String()
+}
+
+var lokiInvalidLabelChars = regexp.MustCompile(`[^a-zA-Z0-9_]`)
+
+// lokiLabelName turns a Kubernetes label name, such as
+// "app.kubernetes.io/name", into a valid Loki label name.
+func lokiLabelName(name string) string {
+	name = lokiInvalidLabelChars.ReplaceAllString(name, "_")
+	if name != "" && name[0] >= '0' && name[0] <= '9' {
+		name = "_" + name
+	}
+	return name
+}
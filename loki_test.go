@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func newTestLokiSink(t *testing.T, url string, options LokiSinkOptions) *LokiSink {
+	t.Helper()
+	options.URL = url
+	sink, err := NewLokiSink(options, http.DefaultClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go sink.Run()
+	return sink
+}
+
+func decodeLokiRequest(t *testing.T, req sinkRequest) *lokiPushRequest {
+	t.Helper()
+	var push lokiPushRequest
+	if err := json.Unmarshal(req.body, &push); err != nil {
+		t.Fatalf("invalid push body: %s", err)
+	}
+	return &push
+}
+
+func TestLokiSinkPush(t *testing.T) {
+	r := newSinkReceiver(t)
+	sink := newTestLokiSink(t, r.URL, LokiSinkOptions{
+		Tenant:     "team",
+		Labels:     []string{"app", "namespace", "missing"},
+		BatchSize:  3,
+		BufferSize: 100,
+		BatchWait:  time.Minute,
+	})
+
+	web, api := newTestPod("default", "web"), newTestPod("default", "api")
+	web.Labels["namespace"] = "wrong"
+	base := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	sink.OnEvent(newTestLogEvent(web, base.Add(2*time.Second), "web 2"))
+	sink.OnEvent(newTestLogEvent(api, base.Add(time.Second), "api 1"))
+	sink.OnEvent(newTestLogEvent(web, base, "web 0"))
+	sink.OnEvent(newTestLogEvent(web, base.Add(3*time.Second), "web 3"))
+	sink.OnEvent(&LogEvent{Kind: LogEventKindEvent, Pod: web})
+
+	req := r.next(t)
+	if req.header.Get("X-Scope-OrgID") != "team" {
+		t.Errorf("got tenant %q", req.header.Get("X-Scope-OrgID"))
+	}
+	push := decodeLokiRequest(t, req)
+	if len(push.Streams) != 2 {
+		t.Fatalf("got %d streams, expected 2", len(push.Streams))
+	}
+	for i, expected := range []struct {
+		labels map[string]string
+		values [][2]string
+	}{
+		{
+			labels: map[string]string{"namespace": "default", "pod": "web", "container": "app", "app": "web"},
+			values: [][2]string{
+				{strconv.FormatInt(base.UnixNano(), 10), "web 0"},
+				{strconv.FormatInt(base.Add(2*time.Second).UnixNano(), 10), "web 2"},
+			},
+		},
+		{
+			labels: map[string]string{"namespace": "default", "pod": "api", "container": "app", "app": "api"},
+			values: [][2]string{{strconv.FormatInt(base.Add(time.Second).UnixNano(), 10), "api 1"}},
+		},
+	} {
+		stream := push.Streams[i]
+		if buildLokiStreamKey(stream.Stream) != buildLokiStreamKey(expected.labels) {
+			t.Errorf("stream %d: got labels %v, expected %v", i, stream.Stream, expected.labels)
+		}
+		if len(stream.Values) != len(expected.values) {
+			t.Errorf("stream %d: got values %v, expected %v", i, stream.Values, expected.values)
+			continue
+		}
+		for j := range expected.values {
+			if stream.Values[j] != expected.values[j] {
+				t.Errorf("stream %d: got values %v, expected %v", i, stream.Values, expected.values)
+			}
+		}
+	}
+
+	// The rest of a batch that isn't full is pushed on closing
+	sink.Close()
+	push = decodeLokiRequest(t, r.next(t))
+	if len(push.Streams) != 1 || len(push.Streams[0].Values) != 1 || push.Streams[0].Values[0][1] != "web 3" {
+		t.Errorf("got %+v", push.Streams)
+	}
+	if r.count() != 0 {
+		t.Errorf("got %d more requests", r.count())
+	}
+}
+
+func TestLokiSinkRetry(t *testing.T) {
+	useFastSinkBackoff(t)
+
+	for _, tc := range []struct {
+		name     string
+		statuses []int
+		attempts int
+	}{
+		{name: "server error", statuses: []int{500, 503}, attempts: 3},
+		{name: "rate limited", statuses: []int{429}, attempts: 2},
+		{name: "bad request is dropped", statuses: []int{400}, attempts: 1},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := newSinkReceiver(t, tc.statuses...)
+			sink := newTestLokiSink(t, r.URL, LokiSinkOptions{BatchSize: 1, BufferSize: 100})
+			pod := newTestPod("default", "web")
+			sink.OnEvent(newTestLogEvent(pod, time.Now(), "first"))
+			for i := 0; i < tc.attempts; i++ {
+				push := decodeLokiRequest(t, r.next(t))
+				if len(push.Streams) != 1 || push.Streams[0].Values[0][1] != "first" {
+					t.Errorf("attempt %d: got %+v", i+1, push.Streams)
+				}
+			}
+
+			// Later lines are still pushed
+			sink.OnEvent(newTestLogEvent(pod, time.Now(), "second"))
+			push := decodeLokiRequest(t, r.next(t))
+			if len(push.Streams) != 1 || push.Streams[0].Values[0][1] != "second" {
+				t.Errorf("got %+v", push.Streams)
+			}
+			sink.Close()
+			if r.count() != 0 {
+				t.Errorf("got %d more requests", r.count())
+			}
+		})
+	}
+}
@@ -6,9 +6,17 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"net"
+	"net/http"
 	"os"
+	"os/signal"
 	"regexp"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"text/template"
 	"time"
 
@@ -30,8 +38,36 @@ func main() {
 	klog.SetLogger(logr.New(&kubeLogger{}))
 
 	cfg := Config{
-		ColorMode:   "auto",
-		ColorScheme: "bw",
+		ColorMode:           "auto",
+		ColorScheme:         "bw",
+		HookConcurrency:     4,
+		HookTimeout:         Duration(30 * time.Second),
+		AlertCooldown:       Duration(5 * time.Minute),
+		AlertContext:        5,
+		TriggerBuffer:       100,
+		TriggerWindow:       Duration(10 * time.Second),
+		TriggerAfter:        Duration(10 * time.Second),
+		ClusterInterval:     Duration(5 * time.Second),
+		ClusterTop:          20,
+		ClusterMaxTemplates: 10000,
+		TopSort:             string(topColumnLines),
+		TopInterval:         Duration(2 * time.Second),
+		TUIHistory:          10000,
+		StreamPriority:      string(StreamPriorityFIFO),
+		BufferSize:          10000,
+		BufferPolicy:        string(BackpressureBlock),
+		Sample:              1,
+		MetricMaxSeries:     1000,
+		LokiBatchSize:       1000,
+		LokiBatchWait:       Duration(time.Second),
+		SyslogFacility:      "user",
+		SyslogMaxSize:       2048,
+		OTLPBatchSize:       1000,
+		OTLPBatchWait:       Duration(time.Second),
+		PipeFormat:          string(PipeFormatRaw),
+		PipeMaxProcesses:    100,
+		RedactMode:          string(RedactModeMask),
+		RedactDetectors:     builtinRedactDetectors,
 	}
 
 	var (
@@ -53,6 +89,73 @@ func main() {
 		noColor               bool
 		colorMode             string
 		colorScheme           string
+		jsonOutput            bool
+		events                bool
+		onEnterCommands       []string
+		onExitCommands        []string
+		onErrorCommands       []string
+		onMatchCommands       []string
+		hookConcurrency       int
+		hookTimeout           time.Duration
+		alertPatterns         []string
+		alertWebhook          string
+		alertCooldown         time.Duration
+		alertContext          int
+		triggerPatterns       []string
+		triggerBuffer         int
+		triggerWindow         time.Duration
+		triggerAfter          time.Duration
+		triggerAll            bool
+		collapse              bool
+		cluster               bool
+		clusterInterval       time.Duration
+		clusterTop            int
+		clusterMaxTemplates   int
+		metricMaxSeries       int
+		summary               bool
+		top                   bool
+		topSort               string
+		topInterval           time.Duration
+		tui                   bool
+		tuiHistory            int
+		pick                  bool
+		pickFollowOwner       bool
+		noKeys                bool
+		idleTimeout           time.Duration
+		passMalformed         bool
+		resumePath            string
+		maxStreams            int
+		streamPriorityString  string
+		streamRotation        time.Duration
+		bufferSize            int
+		bufferPolicyString    string
+		rateLimit             float64
+		sampleString          string
+		limitSpecs            []string
+		metricsAddr           string
+		metricCounters        []string
+		metricHistograms      []string
+		lokiURL               string
+		lokiTenant            string
+		lokiLabels            []string
+		lokiBatchSize         int
+		lokiBatchWait         time.Duration
+		syslogAddress         string
+		syslogFacilityString  string
+		syslogCAFile          string
+		syslogMaxSize         int
+		otlpEndpoint          string
+		otlpHeaders           []string
+		otlpBatchSize         int
+		otlpBatchWait         time.Duration
+		pipeCommand           string
+		pipeFormatString      string
+		pipeTemplateString    string
+		pipeShared            bool
+		pipeMaxProcesses      int
+		redact                bool
+		redactModeString      string
+		redactPatterns        []string
 	)
 
 	if err := cfg.LoadDefault(); err != nil {
@@ -77,12 +180,110 @@ func main() {
 		"Start reading log from the beginning of the container's lifetime.")
 	flags.BoolVarP(&showVersion, "version", "", false, "Show version.")
 	flags.StringVarP(&sinceExpr, "since", "S", "", "Get logs since a given time (e.g. 2023-03-30) or duration (e.g. 1h).")
+	flags.DurationVar(&idleTimeout, "idle-timeout", time.Duration(cfg.IdleTimeout),
+		"Reconnect to a container's log if nothing has been received for this long, in case the stream has"+
+			" stalled (0 disables this). Quiet containers are reconnected too, each time adding a request to the"+
+			" API server.")
+	flags.IntVar(&maxStreams, "max-streams", cfg.MaxStreams,
+		"Maximum number of container logs to stream at the same time (0 means no limit). Other containers"+
+			" wait for a slot.")
+	flags.StringVar(&streamPriorityString, "stream-priority", cfg.StreamPriority,
+		"With --max-streams, which waiting containers get a slot first: one of fifo, namespace (in the order"+
+			" given with --namespace) or newest (most recently created pods).")
+	flags.DurationVar(&streamRotation, "stream-rotate", time.Duration(cfg.StreamRotation),
+		"With --max-streams, let waiting containers take turns with streaming ones after this long (0 disables"+
+			" rotation). Lines are not lost while a container waits.")
+	flags.IntVar(&bufferSize, "buffer-size", cfg.BufferSize,
+		"Maximum number of lines waiting to be output.")
+	flags.StringVar(&bufferPolicyString, "buffer-policy", cfg.BufferPolicy,
+		"What to do when the output can't keep up and the buffer is full: one of block (slow down reading logs),"+
+			" drop-oldest or drop-newest.")
+	flags.Float64Var(&rateLimit, "rate-limit", cfg.RateLimit,
+		"Maximum number of lines per second to output from each container (0 means no limit). Lines"+
+			" beyond the limit are suppressed.")
+	flags.StringVar(&sampleString, "sample", strconv.FormatFloat(cfg.Sample, 'g', -1, 64),
+		"Output only this fraction of each container's lines, chosen at random, such as 0.1 or 10%.")
+	flags.StringArrayVar(&limitSpecs, "limit", []string{},
+		"Limit the lines output from pods or containers whose name matches a regular expression, given as"+
+			" PATTERN=SPEC, where SPEC is a comma-separated list of rate=LINES_PER_SECOND, burst=LINES,"+
+			" sample=FRACTION and every=N (keep 1 in N lines). Can be repeated.")
+	flags.StringVar(&metricsAddr, "metrics-addr", cfg.MetricsAddr,
+		"Serve Prometheus metrics at /metrics on this address, such as :9090.")
+	flags.StringArrayVar(&metricCounters, "metric-counter", []string{},
+		"With --metrics-addr, count log lines matching a regular expression, given as NAME=PATTERN. Named"+
+			" groups become labels. Can be repeated.")
+	flags.StringArrayVar(&metricHistograms, "metric-histogram", []string{},
+		"With --metrics-addr, observe the number captured by the group named \"value\" in log lines matching a"+
+			" regular expression, given as NAME=PATTERN. Other named groups become labels. Can be repeated.")
+	flags.IntVar(&metricMaxSeries, "metric-max-series", cfg.MetricMaxSeries,
+		"Maximum number of label combinations to keep for each derived metric; beyond that, the least"+
+			" recently updated ones are discarded.")
+	flags.StringVar(&lokiURL, "loki-url", cfg.LokiURL,
+		"Also push log lines to Grafana Loki at this URL, such as http://localhost:3100.")
+	flags.StringVar(&lokiTenant, "loki-tenant", cfg.LokiTenant, "Tenant ID to send to Loki as X-Scope-OrgID.")
+	flags.StringArrayVar(&lokiLabels, "loki-label", cfg.LokiLabels,
+		"Pod label to add to the Loki stream labels, in addition to namespace, pod and container. Can be"+
+			" repeated.")
+	flags.IntVar(&lokiBatchSize, "loki-batch-size", cfg.LokiBatchSize, "Maximum number of lines to push to Loki at once.")
+	flags.DurationVar(&lokiBatchWait, "loki-batch-wait", time.Duration(cfg.LokiBatchWait),
+		"How long to wait for more lines before pushing a batch to Loki.")
+	flags.StringVar(&syslogAddress, "syslog", cfg.SyslogAddress,
+		"Also send log lines as RFC 5424 syslog messages to this address, such as udp://host:514,"+
+			" tcp://host:601 or tls://host:6514.")
+	flags.StringVar(&syslogFacilityString, "syslog-facility", cfg.SyslogFacility,
+		"Syslog facility to send messages with, such as user, daemon or local0.")
+	flags.StringVar(&syslogCAFile, "syslog-ca-file", cfg.SyslogCAFile,
+		"File with CA certificates to verify the syslog server with, for tls:// addresses. Defaults to the"+
+			" system's CA certificates.")
+	flags.IntVar(&syslogMaxSize, "syslog-max-size", cfg.SyslogMaxSize,
+		"Maximum size of a syslog message in bytes; longer lines are truncated. At most 65507 over UDP.")
+	flags.StringVar(&otlpEndpoint, "otlp-endpoint", cfg.OTLPEndpoint,
+		"Also export log lines to an OpenTelemetry collector, using OTLP/HTTP with JSON encoding at this URL,"+
+			" such as http://localhost:4318.")
+	flags.StringArrayVar(&otlpHeaders, "otlp-header", []string{},
+		"Header to send with OTLP exports, given as KEY=VALUE. Can be repeated.")
+	flags.IntVar(&otlpBatchSize, "otlp-batch-size", cfg.OTLPBatchSize,
+		"Maximum number of lines to export to OpenTelemetry at once.")
+	flags.DurationVar(&otlpBatchWait, "otlp-batch-wait", time.Duration(cfg.OTLPBatchWait),
+		"How long to wait for more lines before exporting a batch to OpenTelemetry.")
+	flags.StringVar(&pipeCommand, "pipe", cfg.PipeCommand,
+		"Pass log lines through a shell command, such as 'jq -c .', and output what it prints instead. A"+
+			" separate process is run for each container, unless --pipe-shared is given.")
+	flags.StringVar(&pipeFormatString, "pipe-format", cfg.PipeFormat,
+		"How to write lines to the --pipe command: one of raw (the message only), template (see"+
+			" --pipe-template) or json (as with --json).")
+	flags.StringVar(&pipeTemplateString, "pipe-template", cfg.PipeTemplate,
+		"Template to format lines written to the --pipe command, with --pipe-format template.")
+	flags.BoolVar(&pipeShared, "pipe-shared", cfg.PipeShared,
+		"Run a single --pipe process for all containers. Requires --pipe-format json; output lines that are"+
+			" JSON objects naming a container are printed as lines from it, and others as is.")
+	flags.IntVar(&pipeMaxProcesses, "pipe-max-processes", cfg.PipeMaxProcesses,
+		"Maximum number of --pipe processes to run at once, one per container; lines from containers beyond"+
+			" that are dropped. 0 means no limit.")
+	flags.BoolVar(&redact, "redact", cfg.Redact,
+		"Redact secrets and personal information, such as JWTs, bearer tokens, AWS keys, passwords in URLs,"+
+			" email addresses and card numbers, from log lines before they are output anywhere.")
+	flags.StringVar(&redactModeString, "redact-mode", cfg.RedactMode,
+		"How to replace redacted values: one of mask, partial (keep a few characters) or hash (a short hash,"+
+			" so that equal values can be correlated within one run).")
+	flags.StringArrayVar(&redactPatterns, "redact-pattern", []string{},
+		"Also redact what matches a regular expression, given as NAME=PATTERN. If the pattern has capturing"+
+			" groups, only the first group is redacted. Can be repeated.")
+	flags.StringVar(&resumePath, "resume", "",
+		"Save the position in each container's log to this file, and when started again, resume where"+
+			" ktail left off for containers that still exist.")
+	flags.BoolVar(&passMalformed, "pass-malformed", cfg.PassMalformed,
+		"Output log lines that don't start with a valid timestamp, using the time they were received,"+
+			" instead of dropping them.")
+	flags.BoolVarP(&events, "events", "E", cfg.Events,
+		"Also show Kubernetes events (e.g. BackOff, OOMKilled) for matched pods.")
 
 	flags.StringVar(&kubeconfigPath, "kubeconfig", cfg.KubeConfigPath,
 		"Path to kubeconfig (only required out-of-cluster)")
 	flags.StringVarP(&tmplString, "template", "t", cfg.TemplateString,
 		"Template to format each line. For example, for"+
 			" just the message, use --template '{{ .Message }}'.")
+	flags.BoolVarP(&jsonOutput, "json", "j", cfg.JSON, "Output each event as a JSON object on a single line")
 	flags.BoolVarP(&raw, "raw", "r", cfg.Raw, "Don't format output; output messages only (unless --timestamps)")
 	flags.BoolVarP(&timestamps, "timestamps", "T", cfg.Timestamps, "Include timestamps on each line")
 	flags.BoolVarP(&quiet, "quiet", "q", cfg.Quiet, "Don't print events about new/deleted pods")
@@ -91,6 +292,63 @@ func main() {
 	flags.StringVar(&colorMode, "colour", cfg.ColorMode, "Set color mode: one of 'auto' (default), 'never', or 'always'.")
 	flags.StringVar(&colorScheme, "color-scheme", cfg.ColorScheme, "Set color scheme (see https://github.com/alecthomas/chroma/tree/master/styles). (Aliased as --colour-scheme.)")
 	flags.StringVar(&colorScheme, "colour-scheme", cfg.ColorScheme, "Set color scheme (see https://github.com/alecthomas/chroma/tree/master/styles).")
+	flags.StringArrayVar(&onEnterCommands, "on-enter", []string{},
+		"Run a shell command when a container is attached. Can be repeated.")
+	flags.StringArrayVar(&onExitCommands, "on-exit", []string{},
+		"Run a shell command when a container terminates or leaves. Can be repeated.")
+	flags.StringArrayVar(&onErrorCommands, "on-error", []string{},
+		"Run a shell command when tailing a container fails. Can be repeated.")
+	flags.StringArrayVar(&onMatchCommands, "on-match", []string{},
+		"Run a shell command when a log line matches a regular expression, given as PATTERN=COMMAND."+
+			" Can be repeated.")
+	flags.IntVar(&hookConcurrency, "hook-concurrency", cfg.HookConcurrency,
+		"Maximum number of hook commands to run at the same time.")
+	flags.DurationVar(&hookTimeout, "hook-timeout", time.Duration(cfg.HookTimeout),
+		"Kill hook commands that run longer than this.")
+	flags.StringArrayVar(&alertPatterns, "alert", []string{},
+		"Post an alert to the webhook when a log line matches a regular expression. Can be repeated.")
+	flags.StringVar(&alertWebhook, "alert-webhook", cfg.AlertWebhook, "URL to post alerts to as JSON.")
+	flags.DurationVar(&alertCooldown, "alert-cooldown", time.Duration(cfg.AlertCooldown),
+		"Minimum time between alerts for the same rule and container.")
+	flags.IntVar(&alertContext, "alert-context", cfg.AlertContext,
+		"Number of lines before and after the matching line to include in alerts.")
+	flags.StringArrayVar(&triggerPatterns, "trigger", []string{},
+		"Flight recorder mode: buffer lines silently, and only print them when a line matches this"+
+			" regular expression. Can be repeated.")
+	flags.IntVar(&triggerBuffer, "trigger-buffer", cfg.TriggerBuffer,
+		"Maximum number of lines to buffer per container in flight recorder mode.")
+	flags.DurationVar(&triggerWindow, "trigger-window", time.Duration(cfg.TriggerWindow),
+		"How far back to print buffered lines when triggered (0 means print the whole buffer).")
+	flags.DurationVar(&triggerAfter, "trigger-after", time.Duration(cfg.TriggerAfter),
+		"How long to keep printing lines after being triggered.")
+	flags.BoolVar(&triggerAll, "trigger-all", cfg.TriggerAll,
+		"When triggered, print buffered lines from all containers, not just the triggering one.")
+	flags.BoolVar(&collapse, "collapse", cfg.Collapse,
+		"Collapse consecutive identical lines into a single line and a repeat count.")
+	flags.BoolVar(&cluster, "cluster", false,
+		"Instead of printing lines, group them into templates and periodically print the most common ones.")
+	flags.DurationVar(&clusterInterval, "cluster-interval", time.Duration(cfg.ClusterInterval),
+		"How often to print the template table in --cluster mode.")
+	flags.IntVar(&clusterTop, "cluster-top", cfg.ClusterTop, "Number of templates to show in --cluster mode.")
+	flags.IntVar(&clusterMaxTemplates, "cluster-max-templates", cfg.ClusterMaxTemplates,
+		"Maximum number of templates to keep track of in --cluster mode. When there are more, the least"+
+			" common ones are discarded.")
+	flags.BoolVar(&summary, "summary", cfg.Summary, "Print a summary of the session on exit.")
+	flags.BoolVar(&top, "top", false,
+		"Instead of printing lines, show a continuously refreshed table of log throughput per container.")
+	flags.StringVar(&topSort, "top-sort", cfg.TopSort,
+		"Column to sort by in --top mode: one of name, lines, bytes, errors, total or last.")
+	flags.DurationVar(&topInterval, "top-interval", time.Duration(cfg.TopInterval), "How often to refresh the table in --top mode.")
+	flags.BoolVar(&tui, "tui", false,
+		"Show an interactive full-screen view, with a list of containers that can be muted or soloed,"+
+			" scrollback and live filtering.")
+	flags.IntVar(&tuiHistory, "tui-history", cfg.TUIHistory, "Maximum number of lines to keep for scrolling back in --tui mode.")
+	flags.BoolVar(&pick, "pick", false,
+		"Interactively pick the pods and containers to tail from a searchable list.")
+	flags.BoolVar(&pickFollowOwner, "pick-follow-owner", cfg.PickFollowOwner,
+		"With --pick, also tail new pods created by the same owner as the picked pods, such as a Deployment.")
+	flags.BoolVar(&noKeys, "no-keys", false,
+		"Don't read key presses from the terminal while streaming. Useful when running ktail in the background.")
 	_ = flags.MarkHidden("colour")
 	_ = flags.MarkHidden("colour-scheme")
 
@@ -146,6 +404,169 @@ func main() {
 		}
 	}
 
+	hooks, err := buildHooks(cfg.Hooks, hookTimeout)
+	if err != nil {
+		fail(err.Error())
+	}
+	for _, commands := range []struct {
+		trigger  HookTrigger
+		commands []string
+	}{
+		{HookTriggerEnter, onEnterCommands},
+		{HookTriggerExit, onExitCommands},
+		{HookTriggerError, onErrorCommands},
+	} {
+		for _, command := range commands.commands {
+			hooks = append(hooks, Hook{Trigger: commands.trigger, Command: command, Timeout: hookTimeout})
+		}
+	}
+	for _, s := range onMatchCommands {
+		pattern, command, ok := strings.Cut(s, "=")
+		if !ok || command == "" {
+			fail("invalid --on-match flag %q: must be PATTERN=COMMAND", s)
+		}
+		r, err := regexp.Compile(pattern)
+		if err != nil {
+			fail("Invalid regexp: %q: %s\n", pattern, err)
+		}
+		hooks = append(hooks, Hook{Trigger: HookTriggerMatch, Command: command, Pattern: r, Timeout: hookTimeout})
+	}
+
+	alertRuleConfigs := cfg.Alerts
+	for _, pattern := range alertPatterns {
+		alertRuleConfigs = append(alertRuleConfigs, AlertRuleConfig{Name: pattern, Pattern: pattern})
+	}
+	alertRules, err := buildAlertRules(alertRuleConfigs, alertWebhook, alertCooldown)
+	if err != nil {
+		fail(err.Error())
+	}
+
+	limitConfigs := cfg.Limits
+	for _, s := range limitSpecs {
+		c, err := parseLimitSpec(s)
+		if err != nil {
+			fail(err.Error())
+		}
+		limitConfigs = append(limitConfigs, c)
+	}
+	limitRules, err := buildLimitRules(limitConfigs)
+	if err != nil {
+		fail(err.Error())
+	}
+	sample, err := parseFraction(sampleString)
+	if err != nil {
+		fail("invalid --sample %q", sampleString)
+	}
+	defaultLimitRule, err := newLimitRule(rateLimit, 0, sample, 0)
+	if err != nil {
+		fail("invalid --rate-limit or --sample: %s", err)
+	}
+
+	metricRuleConfigs := cfg.Metrics
+	for _, metricFlags := range []struct {
+		metricType MetricType
+		specs      []string
+	}{
+		{MetricTypeCounter, metricCounters},
+		{MetricTypeHistogram, metricHistograms},
+	} {
+		for _, s := range metricFlags.specs {
+			c, err := parseMetricFlag(s, metricFlags.metricType)
+			if err != nil {
+				fail(err.Error())
+			}
+			metricRuleConfigs = append(metricRuleConfigs, c)
+		}
+	}
+	metricRules, err := buildMetricRules(metricRuleConfigs)
+	if err != nil {
+		fail(err.Error())
+	}
+	if len(metricRules) > 0 && metricsAddr == "" {
+		fail("metrics require --metrics-addr")
+	}
+
+	var redactor *Redactor
+	redactPatternConfigs := cfg.RedactPatterns
+	for _, s := range redactPatterns {
+		c, err := parseRedactPattern(s)
+		if err != nil {
+			fail(err.Error())
+		}
+		redactPatternConfigs = append(redactPatternConfigs, c)
+	}
+	if redact || len(redactPatternConfigs) > 0 {
+		var detectors []string
+		if redact {
+			detectors = cfg.RedactDetectors
+		}
+		rules, err := buildRedactRules(detectors, redactPatternConfigs)
+		if err != nil {
+			fail(err.Error())
+		}
+		mode, err := parseRedactMode(redactModeString)
+		if err != nil {
+			fail(err.Error())
+		}
+		if redactor, err = NewRedactor(rules, mode); err != nil {
+			fail(err.Error())
+		}
+	}
+
+	topColumn, err := parseTopColumn(topSort)
+	if err != nil {
+		fail(err.Error())
+	}
+	if top {
+		// Messages about containers would just be erased by the next refresh
+		quiet = true
+	}
+	if tui {
+		if top || cluster || jsonOutput || tmplString != "" {
+			fail("--tui cannot be combined with --top, --cluster, --json or --template")
+		}
+		if !isTerminal(os.Stdin) || !isTerminal(os.Stdout) {
+			fail("--tui requires a terminal")
+		}
+	}
+	pipeFormat, err := parsePipeFormat(pipeFormatString)
+	if err != nil {
+		fail(err.Error())
+	}
+	var pipeTemplate *template.Template
+	if pipeCommand != "" {
+		if tui || top || cluster {
+			fail("--pipe cannot be combined with --tui, --top or --cluster")
+		}
+		if pipeShared && pipeFormat != PipeFormatJSON {
+			fail("--pipe-shared requires --pipe-format json")
+		}
+		if pipeFormat == PipeFormatTemplate {
+			if pipeTemplateString == "" {
+				fail("--pipe-format template requires --pipe-template")
+			}
+			if pipeTemplate, err = template.New("pipe").Parse(pipeTemplateString); err != nil {
+				fail("invalid pipe template: %s", err)
+			}
+		}
+	}
+	if pick && (!isTerminal(os.Stdin) || !isTerminal(os.Stdout)) {
+		fail("--pick requires a terminal")
+	}
+
+	// Quiet can be toggled while running, so it must be safe to read concurrently
+	var quietMode atomic.Bool
+	quietMode.Store(quiet)
+
+	var triggers []*regexp.Regexp
+	for _, p := range triggerPatterns {
+		r, err := regexp.Compile(p)
+		if err != nil {
+			fail("Invalid regexp: %q: %s\n", p, err)
+		}
+		triggers = append(triggers, r)
+	}
+
 	inclusionMatcher := buildMatcher(includePatterns, labelSelector, true)
 	exclusionMatcher := buildMatcher(excludePatterns, nil, false)
 
@@ -193,6 +614,19 @@ func main() {
 		}
 	}
 
+	// All interactive modes share a single reader of the terminal
+	var terminalKeys <-chan keyPress
+	getTerminalKeys := func() <-chan keyPress {
+		if terminalKeys == nil {
+			terminalKeys = decodeKeys(readKeys(os.Stdin))
+		}
+		return terminalKeys
+	}
+
+	if jsonOutput && tmplString != "" {
+		fail("--json and --template are mutually exclusive")
+	}
+
 	var tmpl *template.Template
 	if tmplString != "" {
 		var err error
@@ -214,37 +648,74 @@ func main() {
 		return pod.Name
 	}
 
+	if pick {
+		items, err := listPickerItems(context.Background(), clientset, namespaces,
+			inclusionMatcher, exclusionMatcher, formatPod)
+		if err != nil {
+			fail(err.Error())
+		}
+		if len(items) == 0 {
+			fail("no matching pods found")
+		}
+		restore, err := makeRaw(os.Stdin)
+		if err != nil {
+			fail("could not set up terminal: %s", err)
+		}
+		picked, err := NewPicker(os.Stdout, items).Run(getTerminalKeys())
+		restore()
+		if err != nil {
+			os.Exit(1)
+		}
+		inclusionMatcher = buildPickMatcher(picked, pickFollowOwner)
+	}
+
 	formatPodAndContainer := func(pod *v1.Pod, container *v1.Container) string {
 		return fmt.Sprintf("%s:%s", formatPod(pod), container.Name)
 	}
 
+	formatContainerName := func(namespace, pod, container string) string {
+		if allNamespaces || len(namespaces) > 1 {
+			return fmt.Sprintf("%s/%s:%s", namespace, pod, container)
+		}
+		return fmt.Sprintf("%s:%s", pod, container)
+	}
+
+	// Output is buffered, and flushed when there is nothing more to write for
+	// the moment
+	stdoutBuffer := NewFlushWriter(os.Stdout)
+	var stdout io.Writer = stdoutBuffer
+	beforeMessage = func() {
+		// Errors are reported by whoever flushes next
+		_ = stdoutBuffer.Flush()
+	}
+
 	var printEvent func(*LogEvent) error
 
-	if tmpl != nil {
+	if jsonOutput {
 		printEvent = func(event *LogEvent) error {
-			type templateEvent struct {
-				Pod       *v1.Pod
-				Container *v1.Container
-				Timestamp string
-				Message   string
+			b, err := json.Marshal(newJSONEvent(event))
+			if err != nil {
+				return err
 			}
-
-			var buf bytes.Buffer
-			if err := tmpl.Execute(&buf, &templateEvent{
-				Pod:       event.Pod,
-				Container: event.Container,
-				Message:   event.Message,
-				Timestamp: formatTimestamp(event.Timestamp),
-			}); err != nil {
+			_, err = fmt.Fprintln(stdout, string(b))
+			return err
+		}
+	} else if tmpl != nil {
+		printEvent = func(event *LogEvent) error {
+			line, err := executeTemplate(tmpl, event)
+			if err != nil {
 				return err
 			}
-
-			_, err := fmt.Fprintln(os.Stdout, buf.String())
+			_, err = fmt.Fprintln(stdout, line)
 			return err
 		}
 	} else {
 		printEvent = func(event *LogEvent) error {
-			col := getColorConfig(event.Pod.Name, event.Container.Name)
+			var containerName string
+			if event.Container != nil {
+				containerName = event.Container.Name
+			}
+			col := getColorConfig(event.Pod.Name, containerName)
 
 			var line string
 			if !raw {
@@ -252,15 +723,27 @@ func main() {
 					line = col.metadata.Sprint(formatTimestamp(event.Timestamp))
 					line += " "
 				}
+				label := event.Pod.Name
 				if allNamespaces {
-					line += col.labels.Sprint(fmt.Sprintf("%s/%s:%s",
-						event.Pod.Namespace, event.Pod.Name, event.Container.Name))
-				} else {
-					line += col.labels.Sprint(fmt.Sprintf("%s:%s", event.Pod.Name, event.Container.Name))
+					label = fmt.Sprintf("%s/%s", event.Pod.Namespace, event.Pod.Name)
 				}
+				if event.Container != nil {
+					label += ":" + event.Container.Name
+				}
+				line += col.labels.Sprint(label)
 				line += " "
 			}
 
+			if event.Kind == LogEventKindEvent {
+				eventColor := colorEventNormal
+				if event.Event.Type == v1.EventTypeWarning {
+					eventColor = colorEventWarning
+				}
+				line += eventColor(fmt.Sprintf("[event] %s: %s", formatKubeEvent(event.Event), event.Message))
+				_, err := fmt.Fprintln(stdout, line)
+				return err
+			}
+
 			payload := event.Message
 			if colorEnabled && len(payload) >= 2 && payload[0] == '{' && payload[len(payload)-1] == '}' {
 				var dest interface{}
@@ -274,7 +757,7 @@ func main() {
 
 			line += payload
 
-			_, err := fmt.Fprintln(os.Stdout, line)
+			_, err := fmt.Fprintln(stdout, line)
 			return err
 		}
 	}
@@ -282,26 +765,340 @@ func main() {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
+	var hookRunner *HookRunner
+	if len(hooks) > 0 {
+		hookRunner = NewHookRunner(hooks, hookConcurrency)
+		hookRunner.Run(ctx)
+	}
+
+	var alerter *Alerter
+	if len(alertRules) > 0 {
+		alerter = NewAlerter(alertRules, alertContext, &http.Client{Timeout: 10 * time.Second})
+	}
+
+	var limiter *Limiter
+	if len(limitRules) > 0 || defaultLimitRule.limited() {
+		limiter = NewLimiter(limitRules, defaultLimitRule, formatContainerName)
+		go limiter.Run(ctx, 10*time.Second)
+	}
+
+	var (
+		controller *Controller
+		pipeline   *Pipeline
+	)
+
+	var (
+		metrics         *Metrics
+		metricsListener net.Listener
+	)
+	if metricsAddr != "" {
+		var err error
+		if metricsListener, err = net.Listen("tcp", metricsAddr); err != nil {
+			fail("could not serve metrics: %s", err)
+		}
+		metrics = NewMetrics(metricRules, metricMaxSeries, func() []TailerInfo {
+			return controller.Tailers()
+		}, func() int64 {
+			return pipeline.Dropped()
+		})
+	}
+
+	var sinks []Sink
+	if lokiURL != "" {
+		loki, err := NewLokiSink(LokiSinkOptions{
+			URL:        lokiURL,
+			Tenant:     lokiTenant,
+			Labels:     lokiLabels,
+			BatchSize:  lokiBatchSize,
+			BatchWait:  lokiBatchWait,
+			BufferSize: bufferSize,
+		}, &http.Client{Timeout: 30 * time.Second})
+		if err != nil {
+			fail(err.Error())
+		}
+		go loki.Run()
+		sinks = append(sinks, loki)
+	}
+	if syslogAddress != "" {
+		facility, err := parseSyslogFacility(syslogFacilityString)
+		if err != nil {
+			fail(err.Error())
+		}
+		syslog, err := NewSyslogSink(SyslogSinkOptions{
+			Address:    syslogAddress,
+			Facility:   facility,
+			CAFile:     syslogCAFile,
+			MaxSize:    syslogMaxSize,
+			BufferSize: bufferSize,
+		})
+		if err != nil {
+			fail(err.Error())
+		}
+		go syslog.Run()
+		sinks = append(sinks, syslog)
+	}
+	if otlpEndpoint != "" {
+		headers := map[string]string{}
+		for name, value := range cfg.OTLPHeaders {
+			headers[name] = value
+		}
+		for _, h := range otlpHeaders {
+			name, value, err := parseOTLPHeader(h)
+			if err != nil {
+				fail(err.Error())
+			}
+			headers[name] = value
+		}
+		otlp, err := NewOTLPSink(OTLPSinkOptions{
+			Endpoint:   otlpEndpoint,
+			Headers:    headers,
+			BatchSize:  otlpBatchSize,
+			BatchWait:  otlpBatchWait,
+			BufferSize: bufferSize,
+		}, &http.Client{Timeout: 30 * time.Second})
+		if err != nil {
+			fail(err.Error())
+		}
+		go otlp.Run()
+		sinks = append(sinks, otlp)
+	}
+
+	// Set when output fails, after which lines no longer count as output
+	// for the checkpoints
+	var outputFailed atomic.Bool
+
 	var stdoutMutex sync.Mutex
-	controller := NewController(clientset,
+	write := func(event *LogEvent) {
+		stdoutMutex.Lock()
+		defer stdoutMutex.Unlock()
+		if err := printEvent(event); err != nil {
+			outputFailed.Store(true)
+			printError("Could not write event: %s", err)
+			cancel()
+		}
+	}
+
+	var (
+		clusterer *Clusterer
+		collapser *Collapser
+		tuiView   *TUI
+		controls  *StreamControls
+	)
+	if !(tui || top || cluster || noKeys) && isTerminal(os.Stdin) && isTerminal(os.Stdout) && isForeground(os.Stdin) {
+		controls = NewStreamControls(write, stdoutBuffer, &stdoutMutex, []streamToggle{
+			{key: 't', name: "Timestamps", toggle: func() bool {
+				timestamps = !timestamps
+				return timestamps
+			}},
+			{key: 'r', name: "Raw output", toggle: func() bool {
+				raw = !raw
+				return raw
+			}},
+			{key: 's', name: "Quiet mode", toggle: func() bool {
+				quietMode.Store(!quietMode.Load())
+				return quietMode.Load()
+			}},
+		}, func() {
+			PrintTailers(getMessageOutput(), controller.Tailers(), formatContainerName)
+		})
+		write = controls.Write
+	}
+	if tui {
+		tuiView = NewTUI(func() []TailerInfo {
+			return controller.Tailers()
+		}, os.Stdout, tuiHistory, timestamps, formatContainerName)
+		write = tuiView.Write
+		setMessageOutput(tuiMessageWriter{tuiView})
+	} else if top {
+		write = func(*LogEvent) {}
+	} else if cluster {
+		clusterer = NewClusterer(ClustererOptions{
+			Interval:     clusterInterval,
+			Top:          clusterTop,
+			MaxTemplates: clusterMaxTemplates,
+			Live:         isTerminal(os.Stdout),
+		}, os.Stdout)
+		write = clusterer.Write
+		go clusterer.Run(ctx, &stdoutMutex)
+	} else if collapse {
+		collapser = NewCollapser(write)
+		write = collapser.Write
+		go collapser.Run(ctx)
+	}
+
+	var pipe *Pipe
+	if pipeCommand != "" {
+		var err error
+		pipe, err = NewPipe(PipeOptions{
+			Command:      pipeCommand,
+			Shared:       pipeShared,
+			MaxProcesses: pipeMaxProcesses,
+			Format:       pipeFormat,
+			Template:     pipeTemplate,
+			BufferSize:   bufferSize,
+		}, write, func(line string) {
+			stdoutMutex.Lock()
+			defer stdoutMutex.Unlock()
+			if _, err := fmt.Fprintln(stdout, line); err != nil {
+				outputFailed.Store(true)
+				printError("Could not write output: %s", err)
+				cancel()
+			}
+		})
+		if err != nil {
+			fail(err.Error())
+		}
+		write = pipe.Write
+	}
+
+	var recorder *FlightRecorder
+	if len(triggers) > 0 {
+		recorder = NewFlightRecorder(FlightRecorderOptions{
+			Triggers:      triggers,
+			BufferSize:    triggerBuffer,
+			Window:        triggerWindow,
+			After:         triggerAfter,
+			AllContainers: triggerAll,
+		}, write)
+	}
+
+	var stats *Stats
+	if summary || top {
+		stats = NewStats()
+	}
+
+	emit := func(event LogEvent) {
+		if event.onOutput != nil {
+			// Also when the line is held back or left out below, since it
+			// is then done with as far as resuming goes
+			defer func() {
+				if !outputFailed.Load() {
+					event.onOutput()
+				}
+			}()
+		}
+		if redactor != nil {
+			// Before anything else, so that nothing can leak
+			redactor.Redact(&event)
+		}
+		if stats != nil {
+			stats.OnEvent(&event)
+		}
+		if metrics != nil {
+			metrics.OnEvent(&event)
+		}
+		if hookRunner != nil {
+			hookRunner.OnEvent(&event)
+		}
+		if alerter != nil {
+			alerter.OnEvent(&event)
+		}
+		if limiter != nil && !limiter.Allow(&event) {
+			return
+		}
+		for _, sink := range sinks {
+			sink.OnEvent(&event)
+		}
+		if recorder != nil {
+			recorder.OnEvent(&event)
+			return
+		}
+		write(&event)
+	}
+
+	bufferPolicy, err := parseBackpressurePolicy(bufferPolicyString)
+	if err != nil {
+		fail(err.Error())
+	}
+
+	flushStdout := func() {
+		if err := stdoutBuffer.Flush(); err != nil {
+			outputFailed.Store(true)
+			printError("Could not write output: %s", err)
+			cancel()
+		}
+	}
+	go stdoutBuffer.Run(ctx, 100*time.Millisecond, func(err error) {
+		outputFailed.Store(true)
+		printError("Could not write output: %s", err)
+		cancel()
+	})
+
+	// Tailers hand their events to the pipeline, so that they don't have to
+	// wait for output
+	pipeline = NewPipeline(bufferSize, bufferPolicy, emit, flushStdout)
+	go pipeline.Run()
+	send := pipeline.Send
+
+	onExit := func(pod *v1.Pod, container *v1.Container, status *ContainerExitStatus, message string) {
+		if redactor != nil {
+			status = redactor.RedactExitStatus(status)
+		}
+		if hookRunner != nil {
+			hookRunner.OnExit(pod, container, status)
+		}
+		if alerter != nil {
+			alerter.OnExit(pod, container)
+		}
+		if quietMode.Load() {
+			return
+		}
+		if jsonOutput {
+			now := time.Now()
+			if status.Termination != nil {
+				now = status.Termination.FinishedAt
+			}
+			send(LogEvent{
+				Kind:      LogEventKindExit,
+				Pod:       pod,
+				Container: container,
+				Timestamp: &now,
+				Message:   message,
+				Exit:      status,
+			})
+			return
+		}
+		printInfo("%s (%s) [%s]", message, status, formatPodAndContainer(pod, container))
+	}
+
+	streamPriority, err := parseStreamPriority(streamPriorityString)
+	if err != nil {
+		fail(err.Error())
+	}
+
+	var resumeFrom map[string]*TailerCheckpoint
+	if resumePath != "" {
+		var err error
+		if resumeFrom, err = loadCheckpoints(resumePath); err != nil {
+			fail(err.Error())
+		}
+	}
+
+	controller = NewController(clientset,
 		ControllerOptions{
 			Namespaces:       namespaces,
 			InclusionMatcher: inclusionMatcher,
 			ExclusionMatcher: exclusionMatcher,
 			Since:            since,
 			SinceStart:       sinceStart,
+			Events:           events,
+			IdleTimeout:      idleTimeout,
+			PassMalformed:    passMalformed,
+			ResumeFrom:       resumeFrom,
+			MaxStreams:       maxStreams,
+			StreamPriority:   streamPriority,
+			StreamRotation:   streamRotation,
 		},
 		Callbacks{
-			OnEvent: func(event LogEvent) {
-				stdoutMutex.Lock()
-				defer stdoutMutex.Unlock()
-				if err := printEvent(&event); err != nil {
-					printError(fmt.Sprintf("Could not write event: %s", err))
-					cancel()
-				}
-			},
+			OnEvent: send,
 			OnEnter: func(pod *v1.Pod, container *v1.Container, initialAddPhase bool) bool {
-				if !quiet {
+				if stats != nil {
+					stats.OnEnter(pod, container, initialAddPhase)
+				}
+				if hookRunner != nil {
+					hookRunner.OnEnter(pod, container)
+				}
+				if !quietMode.Load() {
 					if initialAddPhase {
 						printInfo("Attached to container [%s]", formatPodAndContainer(pod, container))
 					} else {
@@ -310,39 +1107,199 @@ func main() {
 				}
 				return true
 			},
-			OnExit: func(pod *v1.Pod, container *v1.Container) {
-				if !quiet {
-					var status = "unknown"
-					for _, containerStatus := range pod.Status.ContainerStatuses {
-						if containerStatus.Name == container.Name {
-							if containerStatus.State.Running != nil {
-								status = "running"
-							} else if containerStatus.State.Waiting != nil {
-								status = "waiting"
-							} else if containerStatus.State.Terminated != nil {
-								status = "terminated"
-							}
-							break
-						}
-					}
-					printInfo(fmt.Sprintf("Container left (%s) [%s]", status,
-						formatPodAndContainer(pod, container)))
+			OnExit: func(pod *v1.Pod, container *v1.Container, status *ContainerExitStatus) {
+				onExit(pod, container, status, "Container left")
+				if stats != nil {
+					stats.OnExit(pod, container)
+				}
+				if metrics != nil {
+					metrics.OnExit(pod, container)
+				}
+				if recorder != nil {
+					recorder.OnExit(buildKey(pod, container))
+				}
+				if pipe != nil {
+					pipe.OnExit(pod, container)
+				}
+			},
+			OnTerminated: func(pod *v1.Pod, container *v1.Container, status *ContainerExitStatus) {
+				onExit(pod, container, status, "Container terminated")
+			},
+			OnGap: func(pod *v1.Pod, container *v1.Container, from, to time.Time) {
+				printInfo("Possible gap between %s and %s after reconnecting [%s]",
+					formatTimestamp(&from), formatTimestamp(&to), formatPodAndContainer(pod, container))
+			},
+			OnMalformed: func(pod *v1.Pod, container *v1.Container, line string, count int) {
+				if redactor != nil {
+					line = redactor.RedactString(line)
+				}
+				// Only warn about the first line, and then at 10, 100, 1000 and so on
+				switch {
+				case count == 1:
+					printError("Malformed log line without timestamp [%s]: %q",
+						formatPodAndContainer(pod, container), truncate(line, 200))
+				case isPowerOfTen(count):
+					printError("%d malformed log lines so far [%s]", count, formatPodAndContainer(pod, container))
 				}
 			},
 			OnNothingDiscovered: func() {
 				printInfo("No matching pods running yet")
 			},
 			OnError: func(pod *v1.Pod, container *v1.Container, err error) {
+				if metrics != nil {
+					metrics.OnError(pod, container)
+				}
+				if hookRunner != nil {
+					hookRunner.OnError(pod, container, err)
+				}
 				printError(fmt.Sprintf("Error while tailing container [%s]: %s",
 					formatPodAndContainer(pod, container), err))
 			},
 		})
 
-	if err := controller.Run(ctx); err != nil && !errors.Is(err, context.Canceled) {
-		printError(err.Error())
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, append([]os.Signal{os.Interrupt, syscall.SIGTERM}, statusSignals...)...)
+
+	restoreTerminal := func() {}
+	tuiDone := make(chan struct{})
+	if tuiView != nil {
+		restore, err := makeRaw(os.Stdin)
+		if err != nil {
+			fail("could not set up terminal: %s", err)
+		}
+		restoreTerminal = restore
+		go func() {
+			defer close(tuiDone)
+			tuiView.Run(ctx, getTerminalKeys(), cancel)
+		}()
+	} else if top {
+		var (
+			out  io.Writer = os.Stdout
+			keys <-chan keyPress
+		)
+		live := isTerminal(os.Stdout)
+		if live && isTerminal(os.Stdin) {
+			if restore, err := makeRaw(os.Stdin); err == nil {
+				restoreTerminal = restore
+				out = crlfWriter{os.Stdout}
+				setMessageOutput(crlfWriter{os.Stderr})
+				keys = getTerminalKeys()
+			}
+		}
+		go NewTopView(stats, out, topInterval, topColumn, live, formatContainerName).Run(ctx, keys, cancel)
+	} else if controls != nil {
+		if restore, err := makeCbreak(os.Stdin); err == nil {
+			restoreTerminal = restore
+			go controls.Run(ctx, getTerminalKeys(), cancel)
+		}
+	}
+
+	go func() {
+		interrupted := false
+		for sig := range signals {
+			if sig == os.Interrupt || sig == syscall.SIGTERM {
+				if interrupted {
+					// Exit immediately on a second signal, without leaving
+					// the terminal in the mode set up for reading keys
+					restoreTerminal()
+					os.Exit(1)
+				}
+				interrupted = true
+				cancel()
+				continue
+			}
+			PrintTailers(getMessageOutput(), controller.Tailers(), formatContainerName)
+		}
+	}()
+
+	var checkpointer *Checkpointer
+	if resumePath != "" {
+		checkpointer = NewCheckpointer(resumePath, 5*time.Second, func() map[string]*TailerCheckpoint {
+			// Lines count as output once written, so that buffered ones
+			// aren't lost if ktail is killed
+			stdoutMutex.Lock()
+			err := stdoutBuffer.Flush()
+			stdoutMutex.Unlock()
+			if err != nil || outputFailed.Load() {
+				return nil
+			}
+			return controller.Checkpoints()
+		})
+		go checkpointer.Run(ctx)
+	}
+
+	if metrics != nil {
+		go func() {
+			if err := metrics.Serve(ctx, metricsListener); err != nil {
+				printError("Could not serve metrics: %s", err)
+			}
+		}()
+	}
+
+	runErr := controller.Run(ctx)
+
+	// All tailers have stopped; write what they have sent
+	pipeline.Close()
+	if alerter != nil {
+		alerter.Close()
+	}
+	for _, sink := range sinks {
+		sink.Close()
+	}
+	if pipe != nil {
+		// Let the processes finish, and write what they print
+		pipe.Close()
+	}
+
+	if tuiView != nil {
+		cancel()
+		<-tuiDone
+	}
+	restoreTerminal()
+	setMessageOutput(os.Stderr)
+
+	if runErr != nil && !errors.Is(runErr, context.Canceled) {
+		printError("%s", runErr)
+	}
+
+	if collapser != nil {
+		collapser.Flush()
+	}
+	if limiter != nil {
+		limiter.Flush()
+	}
+
+	if checkpointer != nil {
+		// All tailers have stopped and what they sent has been written, so
+		// this is the final position
+		if err := checkpointer.Save(); err != nil {
+			printError("Could not save state: %s", err)
+		}
+	}
+
+	// Prevent tailers that are still running from writing any more output
+	stdoutMutex.Lock()
+	_ = stdoutBuffer.Flush()
+
+	if clusterer != nil {
+		clusterer.PrintTable()
+	}
+	if stats != nil && summary {
+		_, _ = fmt.Fprintln(os.Stderr)
+		stats.PrintSummary(os.Stderr, controller.Tailers(), formatContainerName)
+	}
+	if dropped := pipeline.Dropped(); dropped > 0 {
+		printError("Dropped %d lines because output could not keep up", dropped)
 	}
 }
 
+func isPowerOfTen(n int) bool {
+	for n >= 10 && n%10 == 0 {
+		n /= 10
+	}
+	return n == 1
+}
+
 func fail(format string, args ...interface{}) {
 	msg := fmt.Sprintf(format, args...)
 	_, _ = fmt.Fprintf(os.Stderr, fmt.Sprintf("fatal: %s\n", msg))
@@ -373,4 +1330,7 @@ func parseSinceExpr(s string) (*time.Time, error) {
 var (
 	colorInfo  = color.New(color.FgYellow).SprintFunc()
 	colorError = color.New(color.FgRed).SprintFunc()
+
+	colorEventNormal  = color.New(color.FgCyan).SprintFunc()
+	colorEventWarning = color.New(color.FgHiRed).Add(color.Bold).SprintFunc()
 )
@@ -78,6 +78,47 @@ func (m labelSelectorMatcher) Match(value interface{}) bool {
 	return false
 }
 
+// podContainer is matched against when a container must be considered
+// together with its pod.
+type podContainer struct {
+	pod       *v1.Pod
+	container *v1.Container
+}
+
+// exactMatcher matches a single pod, or a single container in a pod if
+// container is set.
+type exactMatcher struct {
+	namespace string
+	pod       string
+	container string
+}
+
+func (m exactMatcher) Match(value interface{}) bool {
+	switch t := value.(type) {
+	case podContainer:
+		return t.pod.Namespace == m.namespace && t.pod.Name == m.pod &&
+			(m.container == "" || t.container.Name == m.container)
+	}
+	return false
+}
+
+// workloadMatcher matches pods belonging to a workload (see workloadName),
+// or a single container in such pods if container is set.
+type workloadMatcher struct {
+	namespace string
+	workload  string
+	container string
+}
+
+func (m workloadMatcher) Match(value interface{}) bool {
+	switch t := value.(type) {
+	case podContainer:
+		return t.pod.Namespace == m.namespace && workloadName(t.pod) == m.workload &&
+			(m.container == "" || t.container.Name == m.container)
+	}
+	return false
+}
+
 type trueMatcher struct{}
 
 func (trueMatcher) Match(value interface{}) bool {
@@ -0,0 +1,435 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+type MetricType string
+
+const (
+	MetricTypeCounter   MetricType = "counter"
+	MetricTypeHistogram MetricType = "histogram"
+
+	// MetricTypeGauge is only used for ktail's own metrics.
+	MetricTypeGauge MetricType = "gauge"
+)
+
+// defaultMetricBuckets suit durations in milliseconds, which are what log
+// lines most often contain.
+var defaultMetricBuckets = []float64{1, 2.5, 5, 10, 25, 50, 100, 250, 500, 1000, 2500, 5000, 10000}
+
+var metricNameRegexp = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+
+// MetricRule derives a metric from log lines matching a regular expression.
+// The named group "value" is the value to observe (or, for counters, to add);
+// other named groups become labels.
+type MetricRule struct {
+	Name    string
+	Help    string
+	Type    MetricType
+	Pattern *regexp.Regexp
+	Buckets []float64
+	labels  []string
+	groups  []int // Indexes of the label groups in the pattern
+	value   int   // Index of the value group, or -1
+}
+
+func buildMetricRules(configs []MetricRuleConfig) ([]*MetricRule, error) {
+	rules := make([]*MetricRule, 0, len(configs))
+	names := map[string]bool{}
+	for _, c := range configs {
+		if !metricNameRegexp.MatchString(c.Name) {
+			return nil, fmt.Errorf("invalid metric name %q", c.Name)
+		}
+		if strings.HasPrefix(c.Name, "ktail_") {
+			return nil, fmt.Errorf("invalid metric name %q: the ktail_ prefix is reserved", c.Name)
+		}
+		if names[c.Name] {
+			return nil, fmt.Errorf("metric %q is defined more than once", c.Name)
+		}
+		names[c.Name] = true
+
+		rule := &MetricRule{
+			Name:    c.Name,
+			Help:    c.Help,
+			Type:    MetricType(c.Type),
+			Buckets: c.Buckets,
+			labels:  []string{"namespace", "container"},
+			value:   -1,
+		}
+		if c.Pattern == "" {
+			return nil, fmt.Errorf("metric %q has no pattern", c.Name)
+		}
+		var err error
+		if rule.Pattern, err = regexp.Compile(c.Pattern); err != nil {
+			return nil, fmt.Errorf("invalid pattern for metric %q: %w", c.Name, err)
+		}
+		for i, group := range rule.Pattern.SubexpNames() {
+			switch {
+			case group == "":
+			case group == "value":
+				rule.value = i
+			case group == "namespace" || group == "container" || group == "le" ||
+				!metricNameRegexp.MatchString(group) || strings.Contains(group, ":"):
+				return nil, fmt.Errorf("invalid group name %q for metric %q", group, c.Name)
+			default:
+				rule.labels = append(rule.labels, group)
+				rule.groups = append(rule.groups, i)
+			}
+		}
+		switch rule.Type {
+		case "":
+			rule.Type = MetricTypeCounter
+		case MetricTypeCounter:
+		case MetricTypeHistogram:
+			if rule.value < 0 {
+				return nil, fmt.Errorf("histogram %q must have a group named \"value\"", c.Name)
+			}
+			if len(rule.Buckets) == 0 {
+				rule.Buckets = defaultMetricBuckets
+			}
+			if !sort.Float64sAreSorted(rule.Buckets) {
+				return nil, fmt.Errorf("buckets of histogram %q must be in increasing order", c.Name)
+			}
+		default:
+			return nil, fmt.Errorf("invalid type %q for metric %q (must be counter or histogram)", c.Type, c.Name)
+		}
+		if rule.Help == "" {
+			rule.Help = fmt.Sprintf("Derived from log lines matching %s", c.Pattern)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// parseMetricFlag parses a metric given on the command line as NAME=PATTERN.
+func parseMetricFlag(s string, metricType MetricType) (MetricRuleConfig, error) {
+	name, pattern, ok := strings.Cut(s, "=")
+	if !ok || name == "" || pattern == "" {
+		return MetricRuleConfig{}, fmt.Errorf("invalid metric %q: must be NAME=PATTERN", s)
+	}
+	return MetricRuleConfig{Name: name, Type: string(metricType), Pattern: pattern}, nil
+}
+
+type metricSeries struct {
+	labels   []string
+	value    float64 // Counter value, or sum of observations
+	count    int64
+	buckets  []int64 // Non-cumulative
+	lastSeen int64   // Value of Metrics.observations when last updated
+}
+
+type containerMetrics struct {
+	namespace string
+	pod       string
+	container string
+	lines     int64
+	bytes     int64
+	errors    int64
+}
+
+// Metrics collects metrics about ktail and metrics derived from log lines,
+// and serves them in the Prometheus text format.
+type Metrics struct {
+	rules        []*MetricRule
+	series       []map[string]*metricSeries // Per rule
+	discarded    []int64                    // Per rule
+	maxSeries    int
+	observations int64
+	containers   map[string]*containerMetrics
+	tailers      func() []TailerInfo
+	dropped      func() int64
+	sync.Mutex
+}
+
+// NewMetrics creates a collector. Each rule keeps at most maxSeries series
+// (if positive), discarding the least recently updated ones beyond that. The
+// tailers and dropped functions are called when metrics are requested.
+func NewMetrics(rules []*MetricRule, maxSeries int, tailers func() []TailerInfo, dropped func() int64) *Metrics {
+	series := make([]map[string]*metricSeries, len(rules))
+	for i := range series {
+		series[i] = map[string]*metricSeries{}
+	}
+	return &Metrics{
+		rules:      rules,
+		series:     series,
+		discarded:  make([]int64, len(rules)),
+		maxSeries:  maxSeries,
+		containers: map[string]*containerMetrics{},
+		tailers:    tailers,
+		dropped:    dropped,
+	}
+}
+
+func (m *Metrics) OnEvent(event *LogEvent) {
+	if event.Kind != LogEventKindLog {
+		return
+	}
+
+	m.Lock()
+	defer m.Unlock()
+
+	cm := m.getContainer(event.Pod, event.Container)
+	cm.lines++
+	cm.bytes += int64(len(event.Message))
+
+	for i, rule := range m.rules {
+		match := rule.Pattern.FindStringSubmatch(event.Message)
+		if match == nil {
+			continue
+		}
+		value := 1.0
+		if rule.value >= 0 {
+			var err error
+			if value, err = strconv.ParseFloat(match[rule.value], 64); err != nil {
+				continue
+			}
+		}
+		labels := make([]string, 0, len(rule.labels))
+		labels = append(labels, event.Pod.Namespace, event.Container.Name)
+		for _, group := range rule.groups {
+			labels = append(labels, match[group])
+		}
+		key := strings.Join(labels, "\xff")
+		s, ok := m.series[i][key]
+		if !ok {
+			if m.maxSeries > 0 && len(m.series[i]) >= m.maxSeries {
+				m.evict(i)
+			}
+			s = &metricSeries{labels: labels}
+			if rule.Type == MetricTypeHistogram {
+				s.buckets = make([]int64, len(rule.Buckets))
+			}
+			m.series[i][key] = s
+		}
+		s.value += value
+		s.count++
+		m.observations++
+		s.lastSeen = m.observations
+		if rule.Type == MetricTypeHistogram {
+			if b := sort.SearchFloat64s(rule.Buckets, value); b < len(s.buckets) {
+				s.buckets[b]++
+			}
+		}
+	}
+}
+
+// evict discards the least recently updated tenth of a rule's series.
+// Discarding many at once keeps labels that never repeat from causing a sort
+// for every line.
+func (m *Metrics) evict(rule int) {
+	series := make([]string, 0, len(m.series[rule]))
+	for key := range m.series[rule] {
+		series = append(series, key)
+	}
+	sort.Slice(series, func(i, j int) bool {
+		return m.series[rule][series[i]].lastSeen < m.series[rule][series[j]].lastSeen
+	})
+	for _, key := range series[:max(1, len(series)/10)] {
+		delete(m.series[rule], key)
+		m.discarded[rule]++
+	}
+}
+
+// OnError counts an error while tailing a container.
+func (m *Metrics) OnError(pod *v1.Pod, container *v1.Container) {
+	m.Lock()
+	defer m.Unlock()
+	m.getContainer(pod, container).errors++
+}
+
+// OnExit forgets a container that has gone away, so that series don't pile
+// up when pods come and go.
+func (m *Metrics) OnExit(pod *v1.Pod, container *v1.Container) {
+	m.Lock()
+	defer m.Unlock()
+	delete(m.containers, buildKey(pod, container))
+}
+
+func (m *Metrics) getContainer(pod *v1.Pod, container *v1.Container) *containerMetrics {
+	key := buildKey(pod, container)
+	cm, ok := m.containers[key]
+	if !ok {
+		cm = &containerMetrics{
+			namespace: pod.Namespace,
+			pod:       pod.Name,
+			container: container.Name,
+		}
+		m.containers[key] = cm
+	}
+	return cm
+}
+
+// Write writes all metrics in the Prometheus text format.
+func (m *Metrics) Write(w io.Writer) error {
+	tailers := m.tailers()
+	dropped := m.dropped()
+
+	var b strings.Builder
+
+	m.Lock()
+	keys := make([]string, 0, len(m.containers))
+	for key := range m.containers {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, metric := range []struct {
+		name, help string
+		value      func(*containerMetrics) int64
+	}{
+		{"ktail_log_lines_total", "Number of log lines received.",
+			func(cm *containerMetrics) int64 { return cm.lines }},
+		{"ktail_log_bytes_total", "Number of bytes of log messages received.",
+			func(cm *containerMetrics) int64 { return cm.bytes }},
+		{"ktail_stream_errors_total", "Number of errors while tailing.",
+			func(cm *containerMetrics) int64 { return cm.errors }},
+	} {
+		writeMetricHeader(&b, metric.name, metric.help, MetricTypeCounter)
+		for _, key := range keys {
+			cm := m.containers[key]
+			writeMetricSample(&b, metric.name, containerLabels(cm.namespace, cm.pod, cm.container),
+				float64(metric.value(cm)))
+		}
+	}
+
+	if len(m.rules) > 0 {
+		writeMetricHeader(&b, "ktail_metric_series_discarded_total",
+			"Number of series of derived metrics discarded to stay within --metric-max-series.", MetricTypeCounter)
+		for i, rule := range m.rules {
+			writeMetricSample(&b, "ktail_metric_series_discarded_total",
+				[]string{formatMetricLabel("metric", rule.Name)}, float64(m.discarded[i]))
+		}
+	}
+
+	for i, rule := range m.rules {
+		writeMetricHeader(&b, rule.Name, rule.Help, rule.Type)
+		keys := make([]string, 0, len(m.series[i]))
+		for key := range m.series[i] {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			s := m.series[i][key]
+			labels := make([]string, len(rule.labels))
+			for j, name := range rule.labels {
+				labels[j] = formatMetricLabel(name, s.labels[j])
+			}
+			if rule.Type == MetricTypeCounter {
+				writeMetricSample(&b, rule.Name, labels, s.value)
+				continue
+			}
+			var cumulative int64
+			for j, bound := range rule.Buckets {
+				cumulative += s.buckets[j]
+				writeMetricSample(&b, rule.Name+"_bucket",
+					append(labels, formatMetricLabel("le", strconv.FormatFloat(bound, 'g', -1, 64))),
+					float64(cumulative))
+			}
+			writeMetricSample(&b, rule.Name+"_bucket", append(labels, `le="+Inf"`), float64(s.count))
+			writeMetricSample(&b, rule.Name+"_sum", labels, s.value)
+			writeMetricSample(&b, rule.Name+"_count", labels, float64(s.count))
+		}
+	}
+	m.Unlock()
+
+	sort.Slice(tailers, func(i, j int) bool {
+		return tailers[i].Namespace+"/"+tailers[i].Pod+"/"+tailers[i].Container <
+			tailers[j].Namespace+"/"+tailers[j].Pod+"/"+tailers[j].Container
+	})
+	writeMetricHeader(&b, "ktail_stream_reconnects_total", "Number of times a log stream was reconnected.",
+		MetricTypeCounter)
+	phases := map[TailerPhase]int{
+		TailerPhaseWaiting:    0,
+		TailerPhaseConnecting: 0,
+		TailerPhaseStreaming:  0,
+		TailerPhaseBackoff:    0,
+	}
+	for _, t := range tailers {
+		if !t.Active {
+			continue
+		}
+		writeMetricSample(&b, "ktail_stream_reconnects_total", containerLabels(t.Namespace, t.Pod, t.Container),
+			float64(t.Reconnects))
+		phases[t.Phase]++
+	}
+
+	writeMetricHeader(&b, "ktail_tailers", "Number of containers being tailed, by phase.", MetricTypeGauge)
+	phaseNames := make([]string, 0, len(phases))
+	for phase := range phases {
+		phaseNames = append(phaseNames, string(phase))
+	}
+	sort.Strings(phaseNames)
+	for _, phase := range phaseNames {
+		writeMetricSample(&b, "ktail_tailers", []string{formatMetricLabel("phase", phase)},
+			float64(phases[TailerPhase(phase)]))
+	}
+
+	writeMetricHeader(&b, "ktail_dropped_events_total",
+		"Number of events dropped because output could not keep up.", MetricTypeCounter)
+	writeMetricSample(&b, "ktail_dropped_events_total", nil, float64(dropped))
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// Serve serves metrics at /metrics until the context is cancelled.
+func (m *Metrics) Serve(ctx context.Context, listener net.Listener) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		_ = m.Write(w)
+	})
+	server := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		_ = server.Shutdown(shutdownCtx)
+	}()
+
+	if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+func containerLabels(namespace, pod, container string) []string {
+	return []string{
+		formatMetricLabel("namespace", namespace),
+		formatMetricLabel("pod", pod),
+		formatMetricLabel("container", container),
+	}
+}
+
+var metricLabelReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatMetricLabel(name, value string) string {
+	return name + `="` + metricLabelReplacer.Replace(value) + `"`
+}
+
+func writeMetricHeader(b *strings.Builder, name, help string, metricType MetricType) {
+	help = strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(help)
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, metricType)
+}
+
+func writeMetricSample(b *strings.Builder, name string, labels []string, value float64) {
+	b.WriteString(name)
+	if len(labels) > 0 {
+		b.WriteString("{" + strings.Join(labels, ",") + "}")
+	}
+	b.WriteString(" " + strconv.FormatFloat(value, 'g', -1, 64) + "\n")
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetricsDiscardsStaleSeries(t *testing.T) {
+	rules, err := buildMetricRules([]MetricRuleConfig{
+		{Name: "requests", Pattern: `request (?P<id>\w+)`},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := NewMetrics(rules, 10, func() []TailerInfo { return nil }, func() int64 { return 0 })
+	pod := newTestPod("default", "web")
+	for i := 0; i < 100; i++ {
+		m.OnEvent(newTestLogEvent(pod, time.Now(), fmt.Sprintf("request id%d", i)))
+		// Kept up to date, so never discarded
+		m.OnEvent(newTestLogEvent(pod, time.Now(), "request frequent"))
+	}
+
+	if len(m.series[0]) > 10 {
+		t.Errorf("got %d series", len(m.series[0]))
+	}
+	if s, ok := m.series[0]["default\xffapp\xfffrequent"]; !ok || s.value != 100 {
+		t.Errorf("frequently updated series was discarded")
+	}
+	if _, ok := m.series[0]["default\xffapp\xffid99"]; !ok {
+		t.Errorf("most recent series was discarded")
+	}
+
+	var b strings.Builder
+	if err := m.Write(&b); err != nil {
+		t.Fatal(err)
+	}
+	expected := fmt.Sprintf("ktail_metric_series_discarded_total{metric=\"requests\"} %d\n", m.discarded[0])
+	if m.discarded[0] == 0 || !strings.Contains(b.String(), expected) {
+		t.Errorf("expected %q in:\n%s", expected, b.String())
+	}
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const otlpLogsPath = "/v1/logs"
+
+var (
+	otlpTraceIDKeys = []string{"trace_id", "traceId", "traceID", "trace.id"}
+	otlpSpanIDKeys  = []string{"span_id", "spanId", "spanID", "span.id"}
+)
+
+// otlpSeverities maps log levels to OpenTelemetry severity numbers and text.
+var otlpSeverities = map[LogLevel]struct {
+	number int
+	text   string
+}{
+	LogLevelTrace: {1, "TRACE"},
+	LogLevelDebug: {5, "DEBUG"},
+	LogLevelInfo:  {9, "INFO"},
+	LogLevelWarn:  {13, "WARN"},
+	LogLevelError: {17, "ERROR"},
+	LogLevelFatal: {21, "FATAL"},
+}
+
+// OTLPSinkOptions configures an OTLPSink.
+type OTLPSinkOptions struct {
+	// Base URL of the OTLP/HTTP receiver, or the full URL of the logs
+	// endpoint.
+	Endpoint string
+
+	// Extra headers to send, such as for authentication.
+	Headers map[string]string
+
+	// Maximum number of lines to export at once, and how long to wait for a
+	// batch to fill up.
+	BatchSize int
+	BatchWait time.Duration
+
+	// Maximum number of lines waiting to be exported.
+	BufferSize int
+}
+
+// OTLPSink exports log lines to an OpenTelemetry collector, using OTLP/HTTP
+// with JSON encoding.
+type OTLPSink struct {
+	options OTLPSinkOptions
+	client  *http.Client
+	queue   *sinkQueue
+	ctx     context.Context
+	cancel  context.CancelFunc
+	done    chan struct{}
+}
+
+func NewOTLPSink(options OTLPSinkOptions, client *http.Client) (*OTLPSink, error) {
+	u, err := url.Parse(options.Endpoint)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid OTLP endpoint %q", options.Endpoint)
+	}
+	if u.Path == "" || u.Path == "/" {
+		u.Path = otlpLogsPath
+	}
+	options.Endpoint = u.String()
+	options.BatchSize = max(1, options.BatchSize)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	return &OTLPSink{
+		options: options,
+		client:  client,
+		queue:   newSinkQueue("OTLP exporter", max(options.BatchSize, options.BufferSize)),
+		ctx:     ctx,
+		cancel:  cancel,
+		done:    make(chan struct{}),
+	}, nil
+}
+
+func (s *OTLPSink) OnEvent(event *LogEvent) {
+	if event.Kind != LogEventKindLog {
+		return
+	}
+	s.queue.Add(*event)
+}
+
+// Run exports batches of lines until the sink is closed.
+func (s *OTLPSink) Run() {
+	defer close(s.done)
+	for {
+		batch, ok := s.queue.Next(s.options.BatchSize, s.options.BatchWait)
+		if !ok {
+			return
+		}
+		s.export(batch)
+	}
+}
+
+// Close exports the lines that are still queued, giving up after a while if
+// the receiver can't be reached.
+func (s *OTLPSink) Close() {
+	s.queue.Close()
+	select {
+	case <-s.done:
+	case <-time.After(10 * time.Second):
+		s.cancel()
+		<-s.done
+	}
+	s.cancel()
+}
+
+func (s *OTLPSink) export(batch []LogEvent) {
+	body, err := json.Marshal(buildOTLPRequest(batch, time.Now()))
+	if err != nil {
+		printError("Could not export %d lines to OTLP: %s", len(batch), err)
+		return
+	}
+	if err := postWithRetry(s.ctx, s.client, s.options.Endpoint, s.options.Headers, body); err != nil {
+		printError("Could not export %d lines to OTLP: %s", len(batch), err)
+	}
+}
+
+// parseOTLPHeader parses a header given on the command line as KEY=VALUE.
+func parseOTLPHeader(s string) (string, string, error) {
+	name, value, ok := strings.Cut(s, "=")
+	if !ok || name == "" {
+		return "", "", fmt.Errorf("invalid OTLP header %q: must be KEY=VALUE", s)
+	}
+	return name, value, nil
+}
+
+type otlpRequest struct {
+	ResourceLogs []*otlpResourceLogs `json:"resourceLogs"`
+}
+
+type otlpResourceLogs struct {
+	Resource  otlpResource    `json:"resource"`
+	ScopeLogs []otlpScopeLogs `json:"scopeLogs"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpScopeLogs struct {
+	Scope      otlpScope        `json:"scope"`
+	LogRecords []*otlpLogRecord `json:"logRecords"`
+}
+
+type otlpScope struct {
+	Name    string `json:"name"`
+	Version string `json:"version,omitempty"`
+}
+
+type otlpLogRecord struct {
+	TimeUnixNano         string    `json:"timeUnixNano"`
+	ObservedTimeUnixNano string    `json:"observedTimeUnixNano"`
+	SeverityNumber       int       `json:"severityNumber,omitempty"`
+	SeverityText         string    `json:"severityText,omitempty"`
+	Body                 otlpValue `json:"body"`
+	TraceID              string    `json:"traceId,omitempty"`
+	SpanID               string    `json:"spanId,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+// buildOTLPRequest groups lines by container, each of which is a resource
+// described by the Kubernetes semantic conventions.
+func buildOTLPRequest(batch []LogEvent, now time.Time) *otlpRequest {
+	req := &otlpRequest{}
+	resources := map[string]*otlpScopeLogs{}
+	for i := range batch {
+		event := &batch[i]
+		key := buildKey(event.Pod, event.Container)
+		scopeLogs, ok := resources[key]
+		if !ok {
+			rl := &otlpResourceLogs{
+				Resource: otlpResource{Attributes: otlpResourceAttributes(event)},
+				ScopeLogs: []otlpScopeLogs{{
+					Scope: otlpScope{Name: "ktail", Version: version},
+				}},
+			}
+			req.ResourceLogs = append(req.ResourceLogs, rl)
+			scopeLogs = &rl.ScopeLogs[0]
+			resources[key] = scopeLogs
+		}
+
+		timestamp := now
+		if event.Timestamp != nil {
+			timestamp = *event.Timestamp
+		}
+		record := &otlpLogRecord{
+			TimeUnixNano:         strconv.FormatInt(timestamp.UnixNano(), 10),
+			ObservedTimeUnixNano: strconv.FormatInt(now.UnixNano(), 10),
+			Body:                 otlpValue{StringValue: event.Message},
+		}
+		if severity, ok := otlpSeverities[event.Level()]; ok {
+			record.SeverityNumber = severity.number
+			record.SeverityText = severity.text
+		}
+		record.TraceID, record.SpanID = extractTraceContext(event.Message)
+		scopeLogs.LogRecords = append(scopeLogs.LogRecords, record)
+	}
+	return req
+}
+
+func otlpResourceAttributes(event *LogEvent) []otlpAttribute {
+	attrs := []otlpAttribute{
+		{Key: "k8s.namespace.name", Value: otlpValue{StringValue: event.Pod.Namespace}},
+		{Key: "k8s.pod.name", Value: otlpValue{StringValue: event.Pod.Name}},
+	}
+	if event.Pod.UID != "" {
+		attrs = append(attrs, otlpAttribute{Key: "k8s.pod.uid", Value: otlpValue{StringValue: string(event.Pod.UID)}})
+	}
+	if event.Container != nil {
+		attrs = append(attrs,
+			otlpAttribute{Key: "k8s.container.name", Value: otlpValue{StringValue: event.Container.Name}})
+	}
+	if event.Pod.Spec.NodeName != "" {
+		attrs = append(attrs,
+			otlpAttribute{Key: "k8s.node.name", Value: otlpValue{StringValue: event.Pod.Spec.NodeName}})
+	}
+	return attrs
+}
+
+// extractTraceContext returns the trace and span IDs of a JSON message, if
+// it has valid ones.
+func extractTraceContext(message string) (string, string) {
+	if len(message) < 2 || message[0] != '{' || message[len(message)-1] != '}' {
+		return "", ""
+	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal([]byte(message), &fields); err != nil {
+		return "", ""
+	}
+	lookup := func(keys []string, size int) string {
+		for _, key := range keys {
+			if s, ok := fields[key].(string); ok {
+				s = strings.ToLower(s)
+				if b, err := hex.DecodeString(s); err == nil && len(b) == size && strings.Trim(s, "0") != "" {
+					return s
+				}
+			}
+		}
+		return ""
+	}
+	traceID := lookup(otlpTraceIDKeys, 16)
+	if traceID == "" {
+		return "", ""
+	}
+	return traceID, lookup(otlpSpanIDKeys, 8)
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func newTestOTLPSink(t *testing.T, endpoint string, options OTLPSinkOptions) *OTLPSink {
+	t.Helper()
+	options.Endpoint = endpoint
+	sink, err := NewOTLPSink(options, http.DefaultClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go sink.Run()
+	return sink
+}
+
+func decodeOTLPRequest(t *testing.T, req sinkRequest) *otlpRequest {
+	t.Helper()
+	var export otlpRequest
+	if err := json.Unmarshal(req.body, &export); err != nil {
+		t.Fatalf("invalid export body: %s", err)
+	}
+	return &export
+}
+
+// otlpMessages returns the messages of each resource in an export.
+func otlpMessages(export *otlpRequest) [][]string {
+	var result [][]string
+	for _, rl := range export.ResourceLogs {
+		var messages []string
+		for _, sl := range rl.ScopeLogs {
+			for _, record := range sl.LogRecords {
+				messages = append(messages, record.Body.StringValue)
+			}
+		}
+		result = append(result, messages)
+	}
+	return result
+}
+
+func TestOTLPSinkExport(t *testing.T) {
+	r := newSinkReceiver(t)
+	sink := newTestOTLPSink(t, r.URL, OTLPSinkOptions{
+		Headers:    map[string]string{"Authorization": "Bearer abc"},
+		BatchSize:  3,
+		BatchWait:  time.Minute,
+		BufferSize: 100,
+	})
+
+	web, api := newTestPod("default", "web"), newTestPod("default", "api")
+	timestamp := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	traced := `{"level":"error","msg":"failed","trace_id":"0123456789ABCDEF0123456789abcdef","span_id":"0123456789abcdef"}`
+	sink.OnEvent(newTestLogEvent(web, timestamp, traced))
+	sink.OnEvent(newTestLogEvent(api, timestamp, "started"))
+	sink.OnEvent(newTestLogEvent(web, timestamp, "WARN slow"))
+	sink.OnEvent(newTestLogEvent(web, timestamp, "next batch"))
+	sink.OnEvent(&LogEvent{Kind: LogEventKindEvent, Pod: web})
+
+	req := r.next(t)
+	if req.header.Get("Authorization") != "Bearer abc" {
+		t.Errorf("got authorization %q", req.header.Get("Authorization"))
+	}
+	export := decodeOTLPRequest(t, req)
+	messages := otlpMessages(export)
+	if len(messages) != 2 || len(messages[0]) != 2 || messages[0][0] != traced || messages[0][1] != "WARN slow" ||
+		len(messages[1]) != 1 || messages[1][0] != "started" {
+		t.Fatalf("got messages %q", messages)
+	}
+
+	rl := export.ResourceLogs[0]
+	attrs := map[string]string{}
+	for _, attr := range rl.Resource.Attributes {
+		attrs[attr.Key] = attr.Value.StringValue
+	}
+	for key, expected := range map[string]string{
+		"k8s.namespace.name": "default",
+		"k8s.pod.name":       "web",
+		"k8s.pod.uid":        "uid-web",
+		"k8s.container.name": "app",
+		"k8s.node.name":      "node-1",
+	} {
+		if attrs[key] != expected {
+			t.Errorf("got %s %q, expected %q", key, attrs[key], expected)
+		}
+	}
+	if rl.ScopeLogs[0].Scope.Name != "ktail" {
+		t.Errorf("got scope %+v", rl.ScopeLogs[0].Scope)
+	}
+
+	record := rl.ScopeLogs[0].LogRecords[0]
+	if record.TimeUnixNano != strconv.FormatInt(timestamp.UnixNano(), 10) || record.ObservedTimeUnixNano == "" {
+		t.Errorf("got times %s, %s", record.TimeUnixNano, record.ObservedTimeUnixNano)
+	}
+	if record.SeverityNumber != 17 || record.SeverityText != "ERROR" {
+		t.Errorf("got severity %d %s", record.SeverityNumber, record.SeverityText)
+	}
+	if record.TraceID != "0123456789abcdef0123456789abcdef" || record.SpanID != "0123456789abcdef" {
+		t.Errorf("got trace %q, span %q", record.TraceID, record.SpanID)
+	}
+	if record := rl.ScopeLogs[0].LogRecords[1]; record.SeverityText != "WARN" || record.TraceID != "" {
+		t.Errorf("got severity %s, trace %q", record.SeverityText, record.TraceID)
+	}
+
+	// The rest of a batch that isn't full is exported on closing
+	sink.Close()
+	if messages := otlpMessages(decodeOTLPRequest(t, r.next(t))); len(messages) != 1 ||
+		len(messages[0]) != 1 || messages[0][0] != "next batch" {
+		t.Errorf("got messages %q", messages)
+	}
+	if r.count() != 0 {
+		t.Errorf("got %d more requests", r.count())
+	}
+}
+
+func TestOTLPSinkRetry(t *testing.T) {
+	useFastSinkBackoff(t)
+
+	for _, tc := range []struct {
+		name     string
+		statuses []int
+		attempts int
+	}{
+		{name: "server error", statuses: []int{502, 500}, attempts: 3},
+		{name: "rate limited", statuses: []int{429}, attempts: 2},
+		{name: "bad request is dropped", statuses: []int{400}, attempts: 1},
+		{name: "unauthorized is dropped", statuses: []int{401}, attempts: 1},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := newSinkReceiver(t, tc.statuses...)
+			sink := newTestOTLPSink(t, r.URL, OTLPSinkOptions{BatchSize: 1, BufferSize: 100})
+			pod := newTestPod("default", "web")
+			sink.OnEvent(newTestLogEvent(pod, time.Now(), "first"))
+			for i := 0; i < tc.attempts; i++ {
+				if messages := otlpMessages(decodeOTLPRequest(t, r.next(t))); len(messages) != 1 ||
+					messages[0][0] != "first" {
+					t.Errorf("attempt %d: got messages %q", i+1, messages)
+				}
+			}
+
+			// Later lines are still exported
+			sink.OnEvent(newTestLogEvent(pod, time.Now(), "second"))
+			if messages := otlpMessages(decodeOTLPRequest(t, r.next(t))); len(messages) != 1 ||
+				messages[0][0] != "second" {
+				t.Errorf("got messages %q", messages)
+			}
+			sink.Close()
+			if r.count() != 0 {
+				t.Errorf("got %d more requests", r.count())
+			}
+		})
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"text/template"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+// jsonEvent is the representation of an event in JSON output.
+type jsonEvent struct {
+	Kind      LogEventKind         `json:"kind"`
+	Timestamp *time.Time           `json:"timestamp,omitempty"`
+	Namespace string               `json:"namespace"`
+	Pod       string               `json:"pod"`
+	Container string               `json:"container,omitempty"`
+	Node      string               `json:"node,omitempty"`
+	Message   string               `json:"message"`
+	Event     *jsonKubeEvent       `json:"event,omitempty"`
+	Exit      *ContainerExitStatus `json:"exit,omitempty"`
+}
+
+type jsonKubeEvent struct {
+	Type      string `json:"type"`
+	Reason    string `json:"reason"`
+	Count     int32  `json:"count,omitempty"`
+	Source    string `json:"source,omitempty"`
+	FieldPath string `json:"fieldPath,omitempty"`
+}
+
+func newJSONEvent(event *LogEvent) *jsonEvent {
+	result := &jsonEvent{
+		Kind:      event.Kind,
+		Timestamp: event.Timestamp,
+		Namespace: event.Pod.Namespace,
+		Pod:       event.Pod.Name,
+		Node:      event.Pod.Spec.NodeName,
+		Message:   event.Message,
+		Exit:      event.Exit,
+	}
+	if event.Container != nil {
+		result.Container = event.Container.Name
+	}
+	if e := event.Event; e != nil {
+		result.Event = &jsonKubeEvent{
+			Type:      e.Type,
+			Reason:    e.Reason,
+			Count:     kubeEventCount(e),
+			Source:    kubeEventSource(e),
+			FieldPath: e.InvolvedObject.FieldPath,
+		}
+	}
+	return result
+}
+
+// templateEvent is what templates given with --template are executed with.
+type templateEvent struct {
+	Kind      LogEventKind
+	Pod       *v1.Pod
+	Container *v1.Container
+	Timestamp string
+	Message   string
+	Event     *v1.Event
+}
+
+func executeTemplate(tmpl *template.Template, event *LogEvent) (string, error) {
+	container := event.Container
+	if container == nil {
+		// Pod-level events have no container; avoid nil errors in templates
+		container = &v1.Container{}
+	}
+
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, &templateEvent{
+		Kind:      event.Kind,
+		Pod:       event.Pod,
+		Container: container,
+		Message:   event.Message,
+		Timestamp: formatTimestamp(event.Timestamp),
+		Event:     event.Event,
+	}); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// formatKubeEvent formats an event's metadata, such as "Warning BackOff (x3)".
+func formatKubeEvent(e *v1.Event) string {
+	s := fmt.Sprintf("%s %s", e.Type, e.Reason)
+	if count := kubeEventCount(e); count > 1 {
+		s += fmt.Sprintf(" (x%d)", count)
+	}
+	return s
+}
+
+func kubeEventCount(e *v1.Event) int32 {
+	if e.Series != nil {
+		return e.Series.Count
+	}
+	return e.Count
+}
+
+func kubeEventSource(e *v1.Event) string {
+	if e.ReportingController != "" {
+		return e.ReportingController
+	}
+	return e.Source.Component
+}
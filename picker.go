@@ -0,0 +1,275 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/fatih/color"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+var errPickerCancelled = errors.New("cancelled")
+
+type pickerItem struct {
+	namespace string
+	pod       string
+	container string // Empty means all containers in the pod
+	workload  string
+	label     string
+	selected  bool
+	score     int
+}
+
+// listPickerItems lists the running and pending pods that match, with one
+// item for each pod and one for each of its containers.
+func listPickerItems(
+	ctx context.Context,
+	client kubernetes.Interface,
+	namespaces []string,
+	inclusionMatcher Matcher,
+	exclusionMatcher Matcher,
+	formatPod func(pod *v1.Pod) string) ([]*pickerItem, error) {
+	var items []*pickerItem
+	for _, ns := range namespaces {
+		pods, err := client.CoreV1().Pods(ns).List(ctx, metav1.ListOptions{})
+		if err != nil {
+			return nil, fmt.Errorf("listing pods in %q: %w", ns, err)
+		}
+		sort.Slice(pods.Items, func(i, j int) bool {
+			return formatPod(&pods.Items[i]) < formatPod(&pods.Items[j])
+		})
+		for i := range pods.Items {
+			pod := &pods.Items[i]
+			if !(pod.Status.Phase == v1.PodRunning || pod.Status.Phase == v1.PodPending) ||
+				exclusionMatcher.Match(pod) {
+				continue
+			}
+
+			var containerItems []*pickerItem
+			for _, containers := range [][]v1.Container{pod.Spec.InitContainers, pod.Spec.Containers} {
+				for j := range containers {
+					container := &containers[j]
+					if exclusionMatcher.Match(container) ||
+						!(inclusionMatcher.Match(pod) || inclusionMatcher.Match(container)) {
+						continue
+					}
+					containerItems = append(containerItems, &pickerItem{
+						namespace: pod.Namespace,
+						pod:       pod.Name,
+						container: container.Name,
+						workload:  workloadName(pod),
+						label:     fmt.Sprintf("%s:%s", formatPod(pod), container.Name),
+					})
+				}
+			}
+			if len(containerItems) == 0 {
+				continue
+			}
+			items = append(items, &pickerItem{
+				namespace: pod.Namespace,
+				pod:       pod.Name,
+				workload:  workloadName(pod),
+				label:     formatPod(pod),
+			})
+			items = append(items, containerItems...)
+		}
+	}
+	return items, nil
+}
+
+// buildPickMatcher builds an inclusion matcher from the picked items. If
+// followOwner is true, pods belonging to the same workload are matched, too.
+func buildPickMatcher(items []*pickerItem, followOwner bool) Matcher {
+	matchers := make(or, 0, len(items))
+	for _, item := range items {
+		if followOwner && item.workload != item.pod {
+			matchers = append(matchers, workloadMatcher{
+				namespace: item.namespace,
+				workload:  item.workload,
+				container: item.container,
+			})
+		} else {
+			matchers = append(matchers, exactMatcher{
+				namespace: item.namespace,
+				pod:       item.pod,
+				container: item.container,
+			})
+		}
+	}
+	return matchers
+}
+
+// Picker is an interactive terminal list for selecting pods and containers,
+// filtered by fuzzy matching.
+type Picker struct {
+	out      *os.File
+	items    []*pickerItem
+	visible  []*pickerItem
+	query    string
+	cursor   int
+	offset   int
+	lastRows int
+}
+
+func NewPicker(out *os.File, items []*pickerItem) *Picker {
+	p := &Picker{out: out, items: items}
+	p.update()
+	return p
+}
+
+// Run shows the picker until the selection is confirmed with Enter, and
+// returns the selected items. If nothing was explicitly selected, the item
+// under the cursor is returned.
+func (p *Picker) Run(keys <-chan keyPress) ([]*pickerItem, error) {
+	_, _ = p.out.WriteString("\x1b[?1049h")
+	defer func() {
+		_, _ = p.out.WriteString("\x1b[?1049l")
+	}()
+
+	p.render()
+	for key := range keys {
+		switch key.name {
+		case "esc", "ctrl-c":
+			return nil, errPickerCancelled
+		case "enter":
+			var selected []*pickerItem
+			for _, item := range p.items {
+				if item.selected {
+					selected = append(selected, item)
+				}
+			}
+			if len(selected) == 0 && p.cursor < len(p.visible) {
+				selected = append(selected, p.visible[p.cursor])
+			}
+			if len(selected) > 0 {
+				return selected, nil
+			}
+		case "tab":
+			if p.cursor < len(p.visible) {
+				p.visible[p.cursor].selected = !p.visible[p.cursor].selected
+				p.cursor = min(p.cursor+1, len(p.visible)-1)
+			}
+		case "up":
+			p.cursor = max(0, p.cursor-1)
+		case "down":
+			p.cursor = max(0, min(p.cursor+1, len(p.visible)-1))
+		case "pgup":
+			p.cursor = max(0, p.cursor-p.lastRows)
+		case "pgdn":
+			p.cursor = max(0, min(p.cursor+p.lastRows, len(p.visible)-1))
+		case "backspace":
+			if len(p.query) > 0 {
+				_, size := utf8.DecodeLastRuneInString(p.query)
+				p.query = p.query[:len(p.query)-size]
+				p.update()
+			}
+		case "":
+			p.query += string(key.r)
+			p.update()
+		}
+		p.render()
+	}
+	return nil, errPickerCancelled
+}
+
+func (p *Picker) update() {
+	p.visible = p.visible[:0]
+	for _, item := range p.items {
+		if score, ok := fuzzyScore(p.query, item.label); ok {
+			item.score = score
+			p.visible = append(p.visible, item)
+		}
+	}
+	if p.query != "" {
+		sort.SliceStable(p.visible, func(i, j int) bool {
+			return p.visible[i].score > p.visible[j].score
+		})
+	}
+	p.cursor, p.offset = 0, 0
+}
+
+func (p *Picker) render() {
+	width, height := terminalSize(p.out)
+	rows := max(1, height-3)
+	p.lastRows = rows
+	if p.cursor < p.offset {
+		p.offset = p.cursor
+	} else if p.cursor >= p.offset+rows {
+		p.offset = p.cursor - rows + 1
+	}
+
+	selected := 0
+	for _, item := range p.items {
+		if item.selected {
+			selected++
+		}
+	}
+
+	var sb strings.Builder
+	sb.WriteString("\x1b[H\x1b[2J")
+	sb.WriteString(padRight(fmt.Sprintf(
+		"Select pods and containers: Tab to select, Enter to confirm, Esc to cancel (%d of %d shown, %d selected)",
+		len(p.visible), len(p.items), selected), width))
+	sb.WriteString("\r\n")
+	sb.WriteString(padRight("> "+p.query, width))
+	sb.WriteString("\r\n\r\n")
+	for i := p.offset; i < len(p.visible) && i < p.offset+rows; i++ {
+		item := p.visible[i]
+		mark := "[ ]"
+		if item.selected {
+			mark = "[x]"
+		}
+		label := item.label
+		if item.container == "" {
+			label += " (all containers)"
+		} else {
+			label = "  " + label
+		}
+		line := padRight(mark+" "+label, width)
+		if i == p.cursor {
+			line = color.New(color.ReverseVideo).Sprint(line)
+		}
+		sb.WriteString(line)
+		if i < p.offset+rows-1 {
+			sb.WriteString("\r\n")
+		}
+	}
+	_, _ = p.out.WriteString(sb.String())
+}
+
+// fuzzyScore returns whether all characters of the query appear in s in
+// order, ignoring case, and a score that favours consecutive matches and
+// matches at the start of words.
+func fuzzyScore(query, s string) (int, bool) {
+	if query == "" {
+		return 0, true
+	}
+	queryRunes := []rune(strings.ToLower(query))
+	score, qi, consecutive := 0, 0, 0
+	var prev rune
+	for i, r := range strings.ToLower(s) {
+		if qi < len(queryRunes) && r == queryRunes[qi] {
+			qi++
+			consecutive++
+			score += consecutive * 2
+			if i == 0 || !(unicode.IsLetter(prev) || unicode.IsDigit(prev)) {
+				score += 5
+			}
+		} else {
+			consecutive = 0
+		}
+		prev = r
+	}
+	if qi < len(queryRunes) {
+		return 0, false
+	}
+	return score - utf8.RuneCountInString(s)/8, true
+}
@@ -0,0 +1,425 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/jpillora/backoff"
+	v1 "k8s.io/api/core/v1"
+)
+
+// How long to keep a container's process after the container has gone, as
+// its last lines may still be on their way through the output pipeline.
+const pipeExitDelay = 5 * time.Second
+
+// How long to wait for a process's output to be closed after it has exited
+// or been killed.
+var pipeWaitDelay = 5 * time.Second
+
+// PipeFormat is how lines are written to pipe processes.
+type PipeFormat string
+
+const (
+	// PipeFormatRaw writes just the message.
+	PipeFormatRaw PipeFormat = "raw"
+
+	// PipeFormatTemplate writes the result of a template.
+	PipeFormatTemplate PipeFormat = "template"
+
+	// PipeFormatJSON writes a JSON object per line, as with --json.
+	PipeFormatJSON PipeFormat = "json"
+)
+
+func parsePipeFormat(s string) (PipeFormat, error) {
+	switch f := PipeFormat(s); f {
+	case PipeFormatRaw, PipeFormatTemplate, PipeFormatJSON:
+		return f, nil
+	}
+	return "", fmt.Errorf("invalid pipe format %q (must be one of raw, template, json)", s)
+}
+
+// PipeOptions configures a Pipe.
+type PipeOptions struct {
+	// Command to run with "sh -c".
+	Command string
+
+	// Run a single process for all containers, instead of one per container.
+	// Requires PipeFormatJSON, so that output can be attributed to containers.
+	Shared bool
+
+	// Maximum number of processes to run at once, one per container. Lines
+	// from containers beyond that are dropped. Not used if Shared.
+	MaxProcesses int
+
+	Format   PipeFormat
+	Template *template.Template // Only used for PipeFormatTemplate
+
+	// Maximum number of lines waiting to be written to each process.
+	BufferSize int
+}
+
+type pipeProcess struct {
+	name      string
+	pod       *v1.Pod       // Nil if shared
+	container *v1.Container // Nil if shared
+	queue     *sinkQueue
+	exitTimer *time.Timer
+}
+
+// Pipe routes log lines through external processes. Each process gets lines
+// on its standard input, and what it writes to its standard output takes the
+// place of the lines in ktail's output. A process that exits is restarted.
+type Pipe struct {
+	options   PipeOptions
+	write     func(*LogEvent)
+	writeLine func(string)
+	processes map[string]*pipeProcess
+	refused   map[string]int64 // Lines dropped per container, for lack of a process
+	shared    *pipeProcess
+	sources   map[string]*pipeSource // Containers whose lines went to the shared process
+	ctx       context.Context
+	cancel    context.CancelFunc
+	wg        sync.WaitGroup
+	outLock   sync.Mutex
+	sync.Mutex
+}
+
+// pipeSource is a container whose lines went to the shared process.
+type pipeSource struct {
+	pod       *v1.Pod
+	container *v1.Container
+	exitTimer *time.Timer
+}
+
+// NewPipe creates a pipe. Output from a container's process is passed to
+// write as lines from that container, as is output from a shared process
+// that is a JSON object naming a container, as written with PipeFormatJSON.
+// Other output from a shared process is passed to writeLine. Events other
+// than log lines are passed straight to write.
+func NewPipe(options PipeOptions, write func(*LogEvent), writeLine func(string)) (*Pipe, error) {
+	if options.Shared && options.Format != PipeFormatJSON {
+		return nil, fmt.Errorf("a shared pipe requires the json format, so that output can be attributed")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Pipe{
+		options:   options,
+		write:     write,
+		writeLine: writeLine,
+		processes: map[string]*pipeProcess{},
+		refused:   map[string]int64{},
+		sources:   map[string]*pipeSource{},
+		ctx:       ctx,
+		cancel:    cancel,
+	}, nil
+}
+
+func (p *Pipe) Write(event *LogEvent) {
+	if event.Kind != LogEventKindLog {
+		p.outLock.Lock()
+		defer p.outLock.Unlock()
+		p.write(event)
+		return
+	}
+
+	p.Lock()
+	defer p.Unlock()
+
+	var proc *pipeProcess
+	if p.options.Shared {
+		if p.shared == nil {
+			p.shared = p.start("shared process", nil, nil)
+		}
+		proc = p.shared
+		key := buildKey(event.Pod, event.Container)
+		if source, ok := p.sources[key]; !ok {
+			p.sources[key] = &pipeSource{pod: event.Pod, container: event.Container}
+		} else if source.exitTimer != nil {
+			// The container is back, so keep it
+			source.exitTimer.Stop()
+			source.exitTimer = nil
+		}
+	} else {
+		key := buildKey(event.Pod, event.Container)
+		if proc = p.processes[key]; proc == nil {
+			if p.options.MaxProcesses > 0 && len(p.processes) >= p.options.MaxProcesses {
+				if p.refused[key] == 0 {
+					printError("Not running pipe command for %s, as %d are already running (see"+
+						" --pipe-max-processes); dropping its lines", key, len(p.processes))
+				}
+				p.refused[key]++
+				return
+			}
+			if dropped, ok := p.refused[key]; ok {
+				printInfo("Running pipe command for %s, after dropping %d lines", key, dropped)
+				delete(p.refused, key)
+			}
+			proc = p.start(key, event.Pod, event.Container)
+			p.processes[key] = proc
+		}
+	}
+	proc.queue.Add(*event)
+}
+
+// OnExit closes the process of a container that has gone away, or with a
+// shared process, forgets the container.
+func (p *Pipe) OnExit(pod *v1.Pod, container *v1.Container) {
+	p.Lock()
+	defer p.Unlock()
+
+	key := buildKey(pod, container)
+	if p.options.Shared {
+		source, ok := p.sources[key]
+		if !ok || source.exitTimer != nil {
+			return
+		}
+		source.exitTimer = time.AfterFunc(pipeExitDelay, func() {
+			p.Lock()
+			defer p.Unlock()
+			if p.sources[key] == source && source.exitTimer != nil {
+				delete(p.sources, key)
+			}
+		})
+		return
+	}
+
+	delete(p.refused, key)
+	proc, ok := p.processes[key]
+	if !ok || proc.exitTimer != nil {
+		return
+	}
+	proc.exitTimer = time.AfterFunc(pipeExitDelay, func() {
+		p.Lock()
+		defer p.Unlock()
+		if p.processes[key] == proc {
+			delete(p.processes, key)
+		}
+		proc.queue.Close()
+	})
+}
+
+// Close closes all processes, and waits for them to finish writing output.
+// Processes that take too long are killed.
+func (p *Pipe) Close() {
+	p.Lock()
+	for _, proc := range p.processes {
+		if proc.exitTimer != nil {
+			proc.exitTimer.Stop()
+		}
+		proc.queue.Close()
+	}
+	if p.shared != nil {
+		p.shared.queue.Close()
+	}
+	p.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		p.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		p.cancel()
+		<-done
+	}
+	p.cancel()
+}
+
+func (p *Pipe) start(name string, pod *v1.Pod, container *v1.Container) *pipeProcess {
+	proc := &pipeProcess{
+		name:      name,
+		pod:       pod,
+		container: container,
+		queue:     newSinkQueue(fmt.Sprintf("Pipe command for %s", name), max(1, p.options.BufferSize)),
+	}
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		p.run(proc)
+	}()
+	return proc
+}
+
+// run runs a process, restarting it whenever it exits, until its queue is
+// closed and emptied.
+func (p *Pipe) run(proc *pipeProcess) {
+	boff := &backoff.Backoff{Min: 500 * time.Millisecond, Max: 30 * time.Second}
+	for {
+		started := time.Now()
+		done, err := p.runOnce(proc)
+		if done {
+			if err != nil {
+				printError("Pipe command for %s failed: %s", proc.name, err)
+			}
+			return
+		}
+		if time.Since(started) > time.Minute {
+			boff.Reset()
+		}
+		delay := boff.Duration()
+		printError("Pipe command for %s exited (%s); restarting in %s", proc.name, err, delay)
+		if !sleep(p.ctx, delay) {
+			return
+		}
+	}
+}
+
+// runOnce runs the process until it exits. It returns true if it exited
+// because there are no more lines to write.
+func (p *Pipe) runOnce(proc *pipeProcess) (bool, error) {
+	cmd := exec.CommandContext(p.ctx, "sh", "-c", p.options.Command)
+	cmd.Stderr = os.Stderr
+	killProcessGroup(cmd)
+	// Processes left behind by the command may hold on to its output, so
+	// read the output through a copy that Wait gives up on after a while,
+	// rather than straight from the pipe
+	stdout, stdoutWriter := io.Pipe()
+	cmd.Stdout = stdoutWriter
+	cmd.WaitDelay = pipeWaitDelay
+	if proc.pod != nil {
+		cmd.Env = append(os.Environ(),
+			"KTAIL_NAMESPACE="+proc.pod.Namespace,
+			"KTAIL_POD="+proc.pod.Name,
+			"KTAIL_CONTAINER="+proc.container.Name,
+			"KTAIL_NODE="+proc.pod.Spec.NodeName)
+	}
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return true, err
+	}
+	if err := cmd.Start(); err != nil {
+		return true, err
+	}
+
+	readDone := make(chan struct{})
+	go func() {
+		defer close(readDone)
+		p.readOutput(proc, stdout)
+	}()
+
+	done, writeErr := p.writeInput(proc, stdin)
+	_ = stdin.Close()
+	err = cmd.Wait()
+	_ = stdoutWriter.Close()
+	<-readDone
+	if done {
+		return true, err
+	}
+	if err == nil {
+		err = writeErr
+	}
+	if err == nil {
+		err = fmt.Errorf("exited early")
+	}
+	return false, err
+}
+
+// writeInput writes lines to the process until the queue is closed and
+// emptied, in which case it returns true, or writing fails.
+func (p *Pipe) writeInput(proc *pipeProcess, stdin io.Writer) (bool, error) {
+	var buf bytes.Buffer
+	for {
+		batch, ok := proc.queue.Next(100, 0)
+		if !ok {
+			return true, nil
+		}
+		buf.Reset()
+		for i := range batch {
+			line, err := p.format(&batch[i])
+			if err != nil {
+				printError("Could not format line for pipe command: %s", err)
+				continue
+			}
+			buf.WriteString(line + "\n")
+		}
+		if _, err := stdin.Write(buf.Bytes()); err != nil {
+			// Most likely the process has exited, so give the lines to the
+			// next one
+			proc.queue.Requeue(batch)
+			return false, err
+		}
+	}
+}
+
+func (p *Pipe) readOutput(proc *pipeProcess, stdout io.Reader) {
+	scanner := bufio.NewScanner(stdout)
+	scanner.Buffer(make([]byte, 64*1024), maxPartialLineSize)
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		pod, container, message := proc.pod, proc.container, line
+		if pod == nil {
+			pod, container, message = p.attribute(line)
+		}
+
+		p.outLock.Lock()
+		if pod == nil {
+			p.writeLine(line)
+		} else {
+			now := time.Now()
+			p.write(&LogEvent{
+				Kind:      LogEventKindLog,
+				Pod:       pod,
+				Container: container,
+				Timestamp: &now,
+				Message:   message,
+			})
+		}
+		p.outLock.Unlock()
+	}
+	if err := scanner.Err(); err != nil {
+		printError("Could not read output of pipe command for %s: %s", proc.name, err)
+		// Keep draining so that the process doesn't block
+		_, _ = io.Copy(io.Discard, stdout)
+	}
+}
+
+// attribute returns the container that a line of output from the shared
+// process came from, and its message, if the line is a JSON object with the
+// fields written by PipeFormatJSON that names a container whose lines were
+// passed to the process.
+func (p *Pipe) attribute(line string) (*v1.Pod, *v1.Container, string) {
+	if !strings.HasPrefix(line, "{") {
+		return nil, nil, ""
+	}
+	var fields struct {
+		Namespace string  `json:"namespace"`
+		Pod       string  `json:"pod"`
+		Container string  `json:"container"`
+		Message   *string `json:"message"`
+	}
+	if err := json.Unmarshal([]byte(line), &fields); err != nil || fields.Message == nil {
+		return nil, nil, ""
+	}
+
+	p.Lock()
+	defer p.Unlock()
+	source, ok := p.sources[fields.Namespace+"/"+fields.Pod+"/"+fields.Container]
+	if !ok {
+		return nil, nil, ""
+	}
+	return source.pod, source.container, *fields.Message
+}
+
+func (p *Pipe) format(event *LogEvent) (string, error) {
+	switch p.options.Format {
+	case PipeFormatJSON:
+		b, err := json.Marshal(newJSONEvent(event))
+		return string(b), err
+	case PipeFormatTemplate:
+		return executeTemplate(p.options.Template, event)
+	default:
+		return event.Message, nil
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// pipeOutput collects what a pipe outputs.
+type pipeOutput struct {
+	lines []string
+	sync.Mutex
+}
+
+func (o *pipeOutput) write(event *LogEvent) {
+	o.Lock()
+	defer o.Unlock()
+	o.lines = append(o.lines, event.Pod.Name+" "+event.Message)
+}
+
+func (o *pipeOutput) writeLine(line string) {
+	o.Lock()
+	defer o.Unlock()
+	o.lines = append(o.lines, "- "+line)
+}
+
+func (o *pipeOutput) sorted() string {
+	o.Lock()
+	defer o.Unlock()
+	sort.Strings(o.lines)
+	return strings.Join(o.lines, ",")
+}
+
+func newTestPipe(t *testing.T, options PipeOptions) (*Pipe, *pipeOutput) {
+	t.Helper()
+	output := &pipeOutput{}
+	options.BufferSize = 100
+	p, err := NewPipe(options, output.write, output.writeLine)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p, output
+}
+
+func TestPipeMaxProcesses(t *testing.T) {
+	p, output := newTestPipe(t, PipeOptions{Command: "cat", Format: PipeFormatRaw, MaxProcesses: 2})
+
+	pods := []string{"a", "b", "c"}
+	for _, name := range pods {
+		p.Write(newTestLogEvent(newTestPod("default", name), time.Now(), "first"))
+	}
+	// A container that has gone makes room for another, as when its exit
+	// timer fires
+	a := newTestPod("default", "a")
+	key := buildKey(a, &a.Spec.Containers[0])
+	p.Lock()
+	p.processes[key].queue.Close()
+	delete(p.processes, key)
+	p.Unlock()
+	p.Write(newTestLogEvent(newTestPod("default", "c"), time.Now(), "second"))
+	p.Close()
+
+	if got := output.sorted(); got != "a first,b first,c second" {
+		t.Errorf("got lines %q", got)
+	}
+	if len(p.refused) != 0 {
+		t.Errorf("got refused containers %v", p.refused)
+	}
+}
+
+func TestPipeSharedAttributesOutput(t *testing.T) {
+	if _, err := NewPipe(PipeOptions{Command: "cat", Shared: true, Format: PipeFormatRaw}, nil, nil); err == nil {
+		t.Error("expected error for shared pipe without json format")
+	}
+
+	// Passes lines through, changes a message, and prints lines of its own
+	p, output := newTestPipe(t, PipeOptions{
+		Command: `sed -e 's/"message":"secret"/"message":"hidden"/'; echo '{"pod":"other","message":"x"}'; echo done`,
+		Shared:  true,
+		Format:  PipeFormatJSON,
+	})
+	p.Write(newTestLogEvent(newTestPod("default", "web"), time.Now(), "hello"))
+	p.Write(newTestLogEvent(newTestPod("default", "api"), time.Now(), "secret"))
+	p.Close()
+
+	expected := `- done,- {"pod":"other","message":"x"},api hidden,web hello`
+	if got := output.sorted(); got != expected {
+		t.Errorf("got lines %q, expected %q", got, expected)
+	}
+}
+
+func TestPipeDoesNotWaitForLeftoverProcesses(t *testing.T) {
+	saved := pipeWaitDelay
+	pipeWaitDelay = 100 * time.Millisecond
+	t.Cleanup(func() {
+		pipeWaitDelay = saved
+	})
+
+	// The background process holds on to the output after the command exits
+	p, output := newTestPipe(t, PipeOptions{Command: "sleep 5 2>/dev/null & cat", Format: PipeFormatRaw})
+	p.Write(newTestLogEvent(newTestPod("default", "web"), time.Now(), "hello"))
+
+	started := time.Now()
+	p.Close()
+	if elapsed := time.Since(started); elapsed > 5*time.Second {
+		t.Errorf("took %s to close", elapsed)
+	}
+	if got := output.sorted(); got != "web hello" {
+		t.Errorf("got lines %q", got)
+	}
+}
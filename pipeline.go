@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// BackpressurePolicy decides what happens when events arrive faster than
+// they can be written.
+type BackpressurePolicy string
+
+const (
+	// BackpressureBlock makes tailers wait until there is room. No events
+	// are lost, but streams may stall.
+	BackpressureBlock BackpressurePolicy = "block"
+
+	// BackpressureDropOldest discards the oldest queued event.
+	BackpressureDropOldest BackpressurePolicy = "drop-oldest"
+
+	// BackpressureDropNewest discards the incoming event.
+	BackpressureDropNewest BackpressurePolicy = "drop-newest"
+)
+
+func parseBackpressurePolicy(s string) (BackpressurePolicy, error) {
+	switch p := BackpressurePolicy(s); p {
+	case BackpressureBlock, BackpressureDropOldest, BackpressureDropNewest:
+		return p, nil
+	}
+	return "", fmt.Errorf("invalid buffer policy %q (must be one of block, drop-oldest, drop-newest)", s)
+}
+
+// Pipeline decouples tailers from output: events are queued, and written
+// by a single goroutine, so that slow output doesn't hold up every stream.
+type Pipeline struct {
+	sink     func(LogEvent)
+	onIdle   func()
+	policy   BackpressurePolicy
+	queue    []LogEvent // Ring buffer
+	head     int
+	length   int
+	dropped  int64
+	reported int64
+	closed   bool
+	notEmpty *sync.Cond
+	notFull  *sync.Cond
+	done     chan struct{}
+	sync.Mutex
+}
+
+// NewPipeline creates a pipeline that passes events to sink. If onIdle is not
+// nil, it is called whenever the queue has been emptied.
+func NewPipeline(capacity int, policy BackpressurePolicy, sink func(LogEvent), onIdle func()) *Pipeline {
+	p := &Pipeline{
+		sink:   sink,
+		onIdle: onIdle,
+		policy: policy,
+		queue:  make([]LogEvent, max(1, capacity)),
+		done:   make(chan struct{}),
+	}
+	p.notEmpty = sync.NewCond(&p.Mutex)
+	p.notFull = sync.NewCond(&p.Mutex)
+	return p
+}
+
+// Send queues an event.
+func (p *Pipeline) Send(event LogEvent) {
+	p.Lock()
+	defer p.Unlock()
+
+	if p.closed {
+		return
+	}
+	if p.length == len(p.queue) {
+		switch p.policy {
+		case BackpressureDropNewest:
+			p.dropped++
+			return
+		case BackpressureDropOldest:
+			p.queue[p.head] = LogEvent{}
+			p.head = (p.head + 1) % len(p.queue)
+			p.length--
+			p.dropped++
+		default:
+			for p.length == len(p.queue) && !p.closed {
+				p.notFull.Wait()
+			}
+			if p.closed {
+				return
+			}
+		}
+	}
+	p.queue[(p.head+p.length)%len(p.queue)] = event
+	p.length++
+	p.notEmpty.Signal()
+}
+
+// Run writes events until Close is called, and then writes any that remain.
+func (p *Pipeline) Run() {
+	defer close(p.done)
+
+	var lastReport time.Time
+	for {
+		p.Lock()
+		if p.length == 0 && p.onIdle != nil && !p.closed {
+			p.Unlock()
+			p.onIdle()
+			p.Lock()
+		}
+		for p.length == 0 && !p.closed {
+			p.notEmpty.Wait()
+		}
+		if p.length == 0 {
+			p.Unlock()
+			return
+		}
+		event := p.queue[p.head]
+		p.queue[p.head] = LogEvent{}
+		p.head = (p.head + 1) % len(p.queue)
+		p.length--
+		p.notFull.Signal()
+
+		var dropped int64
+		if p.dropped > p.reported && time.Since(lastReport) >= 10*time.Second {
+			dropped = p.dropped - p.reported
+			p.reported = p.dropped
+			lastReport = time.Now()
+		}
+		p.Unlock()
+
+		if dropped > 0 {
+			printError("Output is falling behind; dropped %d lines", dropped)
+		}
+		p.sink(event)
+	}
+}
+
+// Close stops accepting events, and waits until all queued events have been
+// written.
+func (p *Pipeline) Close() {
+	p.Lock()
+	p.closed = true
+	p.notEmpty.Broadcast()
+	p.notFull.Broadcast()
+	p.Unlock()
+	<-p.done
+}
+
+// Dropped returns the number of events that have been dropped.
+func (p *Pipeline) Dropped() int64 {
+	p.Lock()
+	defer p.Unlock()
+	return p.dropped
+}
+
+// FlushWriter is a buffered writer that is safe for concurrent use, and can
+// be flushed periodically.
+type FlushWriter struct {
+	w *bufio.Writer
+	sync.Mutex
+}
+
+func NewFlushWriter(w io.Writer) *FlushWriter {
+	return &FlushWriter{w: bufio.NewWriterSize(w, 64*1024)}
+}
+
+func (fw *FlushWriter) Write(p []byte) (int, error) {
+	fw.Lock()
+	defer fw.Unlock()
+	return fw.w.Write(p)
+}
+
+func (fw *FlushWriter) Flush() error {
+	fw.Lock()
+	defer fw.Unlock()
+	return fw.w.Flush()
+}
+
+// Run flushes at the given interval until the context is cancelled. Errors
+// are passed to onError.
+func (fw *FlushWriter) Run(ctx context.Context, interval time.Duration, onError func(error)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := fw.Flush(); err != nil {
+				onError(err)
+				return
+			}
+		}
+	}
+}
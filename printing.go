@@ -2,21 +2,53 @@ package main
 
 import (
 	"fmt"
+	"io"
 	"os"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/go-logr/logr"
 )
 
+// messageOutput is where informational and error messages are written. It
+// is replaced in modes that take over the terminal, while other goroutines
+// may be printing messages.
+var messageOutput = struct {
+	w io.Writer
+	sync.Mutex
+}{w: os.Stderr}
+
+func getMessageOutput() io.Writer {
+	messageOutput.Lock()
+	defer messageOutput.Unlock()
+	return messageOutput.w
+}
+
+func setMessageOutput(w io.Writer) {
+	messageOutput.Lock()
+	defer messageOutput.Unlock()
+	messageOutput.w = w
+}
+
+// beforeMessage, if set, is called before a message is written, so that
+// output that is buffered comes before it.
+var beforeMessage func()
+
 func printInfo(format string, args ...interface{}) {
 	message := fmt.Sprintf(format, args...)
-	_, _ = fmt.Fprint(os.Stderr, colorInfo("==> "+message+"\n"))
+	if beforeMessage != nil {
+		beforeMessage()
+	}
+	_, _ = fmt.Fprint(getMessageOutput(), colorInfo("==> "+message+"\n"))
 }
 
 func printError(format string, args ...interface{}) {
 	message := fmt.Sprintf(format, args...)
-	_, _ = fmt.Fprint(os.Stderr, colorError("==> "+message+"\n"))
+	if beforeMessage != nil {
+		beforeMessage()
+	}
+	_, _ = fmt.Fprint(getMessageOutput(), colorError("==> "+message+"\n"))
 }
 
 func formatTimestamp(t *time.Time) string {
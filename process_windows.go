@@ -0,0 +1,7 @@
+package main
+
+import "os/exec"
+
+// killProcessGroup does nothing on Windows, where only the command itself is
+// killed when it is cancelled.
+func killProcessGroup(*exec.Cmd) {}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+)
+
+type FlightRecorderOptions struct {
+	// Triggers are the patterns that cause buffered lines to be printed.
+	Triggers []*regexp.Regexp
+
+	// BufferSize is the maximum number of events kept per container.
+	BufferSize int
+
+	// Window is how far back, relative to the triggering line, buffered
+	// events are printed. Zero means all buffered events are printed.
+	Window time.Duration
+
+	// After is how long to keep printing once triggered.
+	After time.Duration
+
+	// AllContainers causes a trigger to print the buffers of all containers,
+	// rather than just the container that triggered.
+	AllContainers bool
+}
+
+// FlightRecorder silently keeps a bounded buffer of recent events for each
+// container. When an event matches a trigger, the buffered history is
+// written, followed by all new events for a while, after which the recorder
+// goes quiet again.
+type FlightRecorder struct {
+	FlightRecorderOptions
+	write       func(*LogEvent)
+	buffers     map[string][]*LogEvent
+	activeUntil map[string]time.Time
+	allUntil    time.Time
+	sync.Mutex
+}
+
+func NewFlightRecorder(options FlightRecorderOptions, write func(*LogEvent)) *FlightRecorder {
+	if options.BufferSize < 1 {
+		options.BufferSize = 1
+	}
+	return &FlightRecorder{
+		FlightRecorderOptions: options,
+		write:                 write,
+		buffers:               map[string][]*LogEvent{},
+		activeUntil:           map[string]time.Time{},
+	}
+}
+
+func (fr *FlightRecorder) OnEvent(event *LogEvent) {
+	fr.Lock()
+	defer fr.Unlock()
+
+	now := time.Now()
+	key := logEventKey(event)
+
+	if fr.isTrigger(event) {
+		if fr.AllContainers {
+			if now.After(fr.allUntil) {
+				printInfo("Triggered by [%s]; showing recent lines from all containers", key)
+			}
+			fr.dump(event, fr.allKeys())
+			fr.allUntil = now.Add(fr.After)
+		} else {
+			if now.After(fr.activeUntil[key]) {
+				printInfo("Triggered by [%s]; showing recent lines", key)
+			}
+			fr.dump(event, []string{key})
+			fr.activeUntil[key] = now.Add(fr.After)
+		}
+		fr.write(event)
+		return
+	}
+
+	if now.Before(fr.allUntil) || now.Before(fr.activeUntil[key]) {
+		fr.write(event)
+		return
+	}
+
+	buffer := fr.buffers[key]
+	if len(buffer) >= fr.BufferSize {
+		buffer = buffer[1:]
+	}
+	fr.buffers[key] = append(buffer, event)
+}
+
+// OnExit discards the buffer of a container that is no longer tailed.
+func (fr *FlightRecorder) OnExit(key string) {
+	fr.Lock()
+	defer fr.Unlock()
+	delete(fr.buffers, key)
+	delete(fr.activeUntil, key)
+}
+
+func (fr *FlightRecorder) isTrigger(event *LogEvent) bool {
+	for _, r := range fr.Triggers {
+		if r.MatchString(event.Message) {
+			return true
+		}
+	}
+	return false
+}
+
+func (fr *FlightRecorder) allKeys() []string {
+	keys := make([]string, 0, len(fr.buffers))
+	for key := range fr.buffers {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// dump writes the buffered events for the given containers in timestamp
+// order, and empties their buffers.
+func (fr *FlightRecorder) dump(trigger *LogEvent, keys []string) {
+	var events []*LogEvent
+	for _, key := range keys {
+		for _, event := range fr.buffers[key] {
+			if fr.Window > 0 && event.Timestamp.Before(trigger.Timestamp.Add(-fr.Window)) {
+				continue
+			}
+			events = append(events, event)
+		}
+		delete(fr.buffers, key)
+	}
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].Timestamp.Before(*events[j].Timestamp)
+	})
+	for _, event := range events {
+		fr.write(event)
+	}
+}
+
+// logEventKey returns a key identifying the pod and container of an event,
+// or just the pod if the event has no container.
+func logEventKey(event *LogEvent) string {
+	if event.Container == nil {
+		return event.Pod.Namespace + "/" + event.Pod.Name
+	}
+	return buildKey(event.Pod, event.Container)
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// RedactMode is how redacted values are replaced.
+type RedactMode string
+
+const (
+	// RedactModeMask replaces values with "[REDACTED:kind]".
+	RedactModeMask RedactMode = "mask"
+
+	// RedactModePartial keeps a few characters of each value, such as the
+	// last four digits of card numbers.
+	RedactModePartial RedactMode = "partial"
+
+	// RedactModeHash replaces values with a short keyed hash, so that the
+	// same value can be recognized across lines without being revealed. The
+	// key is random, so hashes only match within one run of ktail.
+	RedactModeHash RedactMode = "hash"
+)
+
+func parseRedactMode(s string) (RedactMode, error) {
+	switch m := RedactMode(s); m {
+	case RedactModeMask, RedactModePartial, RedactModeHash:
+		return m, nil
+	}
+	return "", fmt.Errorf("invalid redaction mode %q (must be one of mask, partial, hash)", s)
+}
+
+// RedactRule finds values to redact. If the pattern has capturing groups,
+// only the first group is redacted; otherwise the whole match is.
+type RedactRule struct {
+	Name    string
+	Pattern *regexp.Regexp
+	Check   func(value string) bool // Optional check of each value
+}
+
+// builtinRedactRules are the built-in detectors, in order of precedence
+// when they overlap.
+var builtinRedactRules = []RedactRule{
+	{
+		Name:    "jwt",
+		Pattern: regexp.MustCompile(`\beyJ[A-Za-z0-9_-]{5,}\.eyJ[A-Za-z0-9_-]{5,}\.[A-Za-z0-9_-]*`),
+	},
+	{
+		Name:    "bearer",
+		Pattern: regexp.MustCompile(`(?i)\bbearer\s+([A-Za-z0-9\-._~+/]{16,}=*)`),
+	},
+	{
+		Name:    "aws-key",
+		Pattern: regexp.MustCompile(`\b(?:AKIA|ASIA)[0-9A-Z]{16}\b`),
+	},
+	{
+		Name: "aws-key",
+		Pattern: regexp.MustCompile(
+			`(?i)aws_?secret_?(?:access_?)?key["']?\s*[:=]\s*["']?([A-Za-z0-9/+=]{40})\b`),
+	},
+	{
+		Name:    "url-password",
+		Pattern: regexp.MustCompile(`\b[a-zA-Z][a-zA-Z0-9+.-]*://[^\s:/@]+:([^\s@/]+)@`),
+	},
+	{
+		Name:    "email",
+		Pattern: regexp.MustCompile(`\b[A-Za-z0-9._%+-]+@[A-Za-z0-9-]+(?:\.[A-Za-z0-9-]+)*\.[A-Za-z]{2,}\b`),
+	},
+	{
+		Name:    "card",
+		Pattern: regexp.MustCompile(`\b\d(?:[ -]?\d){12,18}\b`),
+		Check:   isLuhnValid,
+	},
+}
+
+var builtinRedactDetectors = []string{"jwt", "bearer", "aws-key", "url-password", "email", "card"}
+
+// buildRedactRules returns the built-in detectors with the given names,
+// followed by the patterns from the configuration.
+func buildRedactRules(detectors []string, patterns []RedactPatternConfig) ([]RedactRule, error) {
+	var rules []RedactRule
+	for _, name := range detectors {
+		found := false
+		for _, rule := range builtinRedactRules {
+			if rule.Name == name {
+				rules = append(rules, rule)
+				found = true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("invalid redaction detector %q (must be one of %s)",
+				name, strings.Join(builtinRedactDetectors, ", "))
+		}
+	}
+	for _, c := range patterns {
+		if c.Pattern == "" {
+			return nil, fmt.Errorf("redaction pattern %q has no pattern", c.Name)
+		}
+		r, err := regexp.Compile(c.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid redaction pattern %q: %w", c.Pattern, err)
+		}
+		name := c.Name
+		if name == "" {
+			name = "custom"
+		}
+		rules = append(rules, RedactRule{Name: name, Pattern: r})
+	}
+	return rules, nil
+}
+
+// parseRedactPattern parses a pattern given on the command line as
+// NAME=PATTERN.
+func parseRedactPattern(s string) (RedactPatternConfig, error) {
+	name, pattern, ok := strings.Cut(s, "=")
+	if !ok || name == "" || pattern == "" {
+		return RedactPatternConfig{}, fmt.Errorf("invalid redaction pattern %q: must be NAME=PATTERN", s)
+	}
+	return RedactPatternConfig{Name: name, Pattern: pattern}, nil
+}
+
+type redactSpan struct {
+	start, end int
+	rule       int
+}
+
+// Redactor removes secrets and personal information from messages.
+type Redactor struct {
+	rules   []RedactRule
+	mode    RedactMode
+	hashKey []byte
+}
+
+func NewRedactor(rules []RedactRule, mode RedactMode) (*Redactor, error) {
+	r := &Redactor{rules: rules, mode: mode}
+	if mode == RedactModeHash {
+		// Without a secret key, values with few possible values, such as
+		// card numbers, could be recovered by hashing them all
+		r.hashKey = make([]byte, 32)
+		if _, err := rand.Read(r.hashKey); err != nil {
+			return nil, fmt.Errorf("could not generate redaction key: %w", err)
+		}
+	}
+	return r, nil
+}
+
+// Redact redacts an event's message in place.
+func (r *Redactor) Redact(event *LogEvent) {
+	event.Message = r.RedactString(event.Message)
+}
+
+// RedactExitStatus returns a copy of a container's status with the messages
+// redacted, as termination messages are written by the container.
+func (r *Redactor) RedactExitStatus(status *ContainerExitStatus) *ContainerExitStatus {
+	result := *status
+	result.Message = r.RedactString(status.Message)
+	for _, termination := range []**ContainerTermination{&result.Termination, &result.LastTermination} {
+		if *termination != nil {
+			t := **termination
+			t.Message = r.RedactString(t.Message)
+			*termination = &t
+		}
+	}
+	return &result
+}
+
+// RedactString redacts a string. All rules are matched against the original
+// string, so that the result of one redaction is never matched by another.
+func (r *Redactor) RedactString(s string) string {
+	var spans []redactSpan
+	for i, rule := range r.rules {
+		for _, m := range rule.Pattern.FindAllStringSubmatchIndex(s, -1) {
+			start, end := m[0], m[1]
+			if len(m) >= 4 {
+				if m[2] < 0 {
+					continue
+				}
+				start, end = m[2], m[3]
+			}
+			if start == end || (rule.Check != nil && !rule.Check(s[start:end])) {
+				continue
+			}
+			spans = append(spans, redactSpan{start: start, end: end, rule: i})
+		}
+	}
+	if len(spans) == 0 {
+		return s
+	}
+
+	// Where matches overlap, the earliest wins, and then the first rule
+	sort.SliceStable(spans, func(i, j int) bool {
+		if spans[i].start != spans[j].start {
+			return spans[i].start < spans[j].start
+		}
+		return spans[i].rule < spans[j].rule
+	})
+
+	var b strings.Builder
+	pos := 0
+	for _, span := range spans {
+		if span.start < pos {
+			continue
+		}
+		b.WriteString(s[pos:span.start])
+		b.WriteString(r.replace(r.rules[span.rule].Name, s[span.start:span.end]))
+		pos = span.end
+	}
+	b.WriteString(s[pos:])
+	return b.String()
+}
+
+func (r *Redactor) replace(kind, value string) string {
+	switch r.mode {
+	case RedactModeHash:
+		mac := hmac.New(sha256.New, r.hashKey)
+		mac.Write([]byte(value))
+		return "[" + kind + ":" + hex.EncodeToString(mac.Sum(nil)[:4]) + "]"
+	case RedactModePartial:
+		return partialMask(kind, value)
+	default:
+		return "[REDACTED:" + kind + "]"
+	}
+}
+
+// partialMask masks most of a value, keeping enough to tell values apart
+// at a glance. Values that don't look as expected for their kind, as
+// patterns from the configuration can use the same names, are masked like
+// values of any other kind.
+func partialMask(kind, value string) string {
+	switch kind {
+	case "card":
+		digits := strings.Map(func(r rune) rune {
+			if r >= '0' && r <= '9' {
+				return r
+			}
+			return -1
+		}, value)
+		// Keep the last four only if there are at least as many masked
+		if len(digits) >= 8 {
+			return strings.Repeat("*", len(digits)-4) + digits[len(digits)-4:]
+		}
+	case "email":
+		local, domain, ok := strings.Cut(value, "@")
+		if ok && local != "" && domain != "" {
+			first, size := utf8.DecodeRuneInString(local)
+			if first != utf8.RuneError || size > 1 {
+				return string(first) + "***@" + domain
+			}
+		}
+	}
+	runes := []rune(value)
+	if len(runes) < 12 {
+		return strings.Repeat("*", len(runes))
+	}
+	return string(runes[:2]) + strings.Repeat("*", len(runes)-4) + string(runes[len(runes)-2:])
+}
+
+// isLuhnValid returns whether a number, which may contain spaces and dashes,
+// passes the Luhn check used by card numbers.
+func isLuhnValid(s string) bool {
+	sum, n := 0, 0
+	for i := len(s) - 1; i >= 0; i-- {
+		c := s[i]
+		if c == ' ' || c == '-' {
+			continue
+		}
+		if c < '0' || c > '9' {
+			return false
+		}
+		d := int(c - '0')
+		if n%2 == 1 {
+			d *= 2
+			if d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+		n++
+	}
+	return n >= 13 && sum%10 == 0
+}
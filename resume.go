@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// TailerCheckpoint is the position of a tailer in a container's log: the
+// timestamp of the last line output, and the lines output within that
+// second, so that lines replayed when resuming can be recognized.
+type TailerCheckpoint struct {
+	LastLine time.Time        `json:"lastLine"`
+	Lines    []checkpointLine `json:"lines,omitempty"`
+}
+
+type checkpointLine struct {
+	Timestamp time.Time `json:"timestamp"`
+	Checksum  string    `json:"checksum"`
+	Count     int       `json:"count"`
+}
+
+func newTailerCheckpoint(lastLine time.Time, window *lineWindow) *TailerCheckpoint {
+	cp := &TailerCheckpoint{LastLine: lastLine}
+	for key, count := range window.lines {
+		if count == 0 {
+			continue
+		}
+		cp.Lines = append(cp.Lines, checkpointLine{
+			Timestamp: time.Unix(0, key.timestamp).UTC(),
+			Checksum:  hex.EncodeToString(key.checksum[:]),
+			Count:     count,
+		})
+	}
+	return cp
+}
+
+func (cp *TailerCheckpoint) window() lineWindow {
+	w := lineWindow{
+		start: cp.LastLine.Truncate(time.Second),
+		lines: map[lineKey]int{},
+	}
+	for _, line := range cp.Lines {
+		key := lineKey{timestamp: line.Timestamp.UnixNano()}
+		if b, err := hex.DecodeString(line.Checksum); err == nil && len(b) == len(key.checksum) {
+			copy(key.checksum[:], b)
+			w.lines[key] = line.Count
+		}
+	}
+	return w
+}
+
+type checkpointFile struct {
+	Containers map[string]*TailerCheckpoint `json:"containers"`
+}
+
+// loadCheckpoints reads checkpoints, keyed by container key, from a file
+// written by saveCheckpoints. A missing file is not an error.
+func loadCheckpoints(path string) (map[string]*TailerCheckpoint, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return map[string]*TailerCheckpoint{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var f checkpointFile
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, fmt.Errorf("parsing state file %q: %w", path, err)
+	}
+	if f.Containers == nil {
+		f.Containers = map[string]*TailerCheckpoint{}
+	}
+	return f.Containers, nil
+}
+
+// saveCheckpoints writes checkpoints to a file. The file is replaced
+// atomically, so that it is never left half-written.
+func saveCheckpoints(path string, checkpoints map[string]*TailerCheckpoint) error {
+	data, err := json.MarshalIndent(checkpointFile{Containers: checkpoints}, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = os.Remove(tmp.Name())
+	}()
+	if _, err := tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// Checkpointer periodically saves the checkpoints of all tailers to a file.
+// The get function returns nil when the checkpoints can't be trusted, such as
+// after output has failed, in which case the file is left alone.
+type Checkpointer struct {
+	path     string
+	interval time.Duration
+	get      func() map[string]*TailerCheckpoint
+	sync.Mutex
+}
+
+func NewCheckpointer(path string, interval time.Duration, get func() map[string]*TailerCheckpoint) *Checkpointer {
+	return &Checkpointer{
+		path:     path,
+		interval: interval,
+		get:      get,
+	}
+}
+
+// Run saves checkpoints until the context is cancelled.
+func (c *Checkpointer) Run(ctx context.Context) {
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := c.Save(); err != nil {
+				printError("Could not save state: %s", err)
+			}
+		}
+	}
+}
+
+func (c *Checkpointer) Save() error {
+	// Serialize saves so that an older state never replaces a newer one
+	c.Lock()
+	defer c.Unlock()
+	checkpoints := c.get()
+	if checkpoints == nil {
+		return nil
+	}
+	return saveCheckpoints(c.path, checkpoints)
+}
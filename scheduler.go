@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// StreamPriority decides which waiting container gets the next free stream.
+type StreamPriority string
+
+const (
+	// StreamPriorityFIFO serves containers in the order they were discovered.
+	StreamPriorityFIFO StreamPriority = "fifo"
+
+	// StreamPriorityNamespace serves containers in the order of the namespaces
+	// given on the command line.
+	StreamPriorityNamespace StreamPriority = "namespace"
+
+	// StreamPriorityNewest serves containers in the most recently created pods
+	// first.
+	StreamPriorityNewest StreamPriority = "newest"
+)
+
+func parseStreamPriority(s string) (StreamPriority, error) {
+	switch p := StreamPriority(s); p {
+	case StreamPriorityFIFO, StreamPriorityNamespace, StreamPriorityNewest:
+		return p, nil
+	}
+	return "", fmt.Errorf("invalid stream priority %q (must be one of fifo, namespace, newest)", s)
+}
+
+type streamWaiter struct {
+	tailer     *ContainerTailer
+	preempt    func()
+	ready      chan struct{}
+	seq        int
+	lastServed time.Time
+}
+
+type streamHolder struct {
+	granted    time.Time
+	preempt    func()
+	preempting bool
+}
+
+// StreamScheduler limits the number of log streams that are open at the same
+// time. Tailers wait for a slot before connecting, and give it up while not
+// streaming. If rotation is enabled, tailers that have held a slot for the
+// rotation interval are preempted when others are waiting, so that every
+// container is eventually served.
+type StreamScheduler struct {
+	max        int
+	rotate     time.Duration
+	less       func(a, b *ContainerTailer) bool
+	active     map[*ContainerTailer]*streamHolder
+	waiting    []*streamWaiter
+	lastServed map[*ContainerTailer]time.Time
+	seq        int
+	sync.Mutex
+}
+
+// NewStreamScheduler creates a scheduler. The namespaces are used for
+// StreamPriorityNamespace.
+func NewStreamScheduler(
+	max int,
+	priority StreamPriority,
+	rotate time.Duration,
+	namespaces []string) *StreamScheduler {
+	var less func(a, b *ContainerTailer) bool
+	switch priority {
+	case StreamPriorityNamespace:
+		order := map[string]int{}
+		for i, ns := range namespaces {
+			order[ns] = i
+		}
+		less = func(a, b *ContainerTailer) bool {
+			return order[a.pod.Namespace] < order[b.pod.Namespace]
+		}
+	case StreamPriorityNewest:
+		less = func(a, b *ContainerTailer) bool {
+			return a.pod.CreationTimestamp.After(b.pod.CreationTimestamp.Time)
+		}
+	default:
+		less = func(a, b *ContainerTailer) bool {
+			return false
+		}
+	}
+
+	return &StreamScheduler{
+		max:        max,
+		rotate:     rotate,
+		less:       less,
+		active:     map[*ContainerTailer]*streamHolder{},
+		lastServed: map[*ContainerTailer]time.Time{},
+	}
+}
+
+// Run preempts tailers that have held their slot for too long, until the
+// context is cancelled. It does nothing if rotation is disabled.
+func (s *StreamScheduler) Run(ctx context.Context) {
+	if s.rotate <= 0 {
+		return
+	}
+	ticker := time.NewTicker(min(s.rotate/2, time.Second))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.rotateSlots()
+		}
+	}
+}
+
+// Acquire waits for a slot. If the tailer is later preempted, preempt is
+// called, after which the tailer is expected to stop streaming and call
+// Release. It returns false if the context was cancelled first.
+func (s *StreamScheduler) Acquire(ctx context.Context, tailer *ContainerTailer, preempt func()) bool {
+	s.Lock()
+	if len(s.active) < s.max && len(s.waiting) == 0 {
+		s.active[tailer] = &streamHolder{granted: time.Now(), preempt: preempt}
+		s.Unlock()
+		return true
+	}
+
+	s.seq++
+	w := &streamWaiter{
+		tailer:     tailer,
+		preempt:    preempt,
+		ready:      make(chan struct{}),
+		seq:        s.seq,
+		lastServed: s.lastServed[tailer],
+	}
+	s.waiting = append(s.waiting, w)
+	s.sortWaiting()
+	s.Unlock()
+
+	select {
+	case <-w.ready:
+		return true
+	case <-ctx.Done():
+		s.Lock()
+		defer s.Unlock()
+		for i, other := range s.waiting {
+			if other == w {
+				s.waiting = append(s.waiting[:i], s.waiting[i+1:]...)
+				return false
+			}
+		}
+		// Granted in the meantime
+		s.release(tailer)
+		return false
+	}
+}
+
+// Release gives up the tailer's slot.
+func (s *StreamScheduler) Release(tailer *ContainerTailer) {
+	s.Lock()
+	defer s.Unlock()
+	s.release(tailer)
+}
+
+// Forget removes what is known about a tailer that has stopped.
+func (s *StreamScheduler) Forget(tailer *ContainerTailer) {
+	s.Lock()
+	defer s.Unlock()
+	delete(s.lastServed, tailer)
+}
+
+func (s *StreamScheduler) release(tailer *ContainerTailer) {
+	if _, ok := s.active[tailer]; !ok {
+		return
+	}
+	delete(s.active, tailer)
+	s.lastServed[tailer] = time.Now()
+
+	for len(s.active) < s.max && len(s.waiting) > 0 {
+		w := s.waiting[0]
+		s.waiting = s.waiting[1:]
+		s.active[w.tailer] = &streamHolder{granted: time.Now(), preempt: w.preempt}
+		close(w.ready)
+	}
+}
+
+// sortWaiting orders waiting tailers so that those that have not been served
+// for the longest come first, and among those, by priority.
+func (s *StreamScheduler) sortWaiting() {
+	sort.SliceStable(s.waiting, func(i, j int) bool {
+		a, b := s.waiting[i], s.waiting[j]
+		if !a.lastServed.Equal(b.lastServed) {
+			return a.lastServed.Before(b.lastServed)
+		}
+		if s.less(a.tailer, b.tailer) {
+			return true
+		}
+		if s.less(b.tailer, a.tailer) {
+			return false
+		}
+		return a.seq < b.seq
+	})
+}
+
+func (s *StreamScheduler) rotateSlots() {
+	s.Lock()
+	defer s.Unlock()
+
+	pending := len(s.waiting)
+	for _, holder := range s.active {
+		if holder.preempting {
+			pending--
+		}
+	}
+
+	var overdue []*streamHolder
+	for _, holder := range s.active {
+		if !holder.preempting && time.Since(holder.granted) >= s.rotate {
+			overdue = append(overdue, holder)
+		}
+	}
+	sort.Slice(overdue, func(i, j int) bool {
+		return overdue[i].granted.Before(overdue[j].granted)
+	})
+	for i := 0; i < len(overdue) && i < pending; i++ {
+		overdue[i].preempting = true
+		overdue[i].preempt()
+	}
+}
@@ -0,0 +1,11 @@
+//go:build !windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// statusSignals are the signals that cause the tailer table to be printed.
+var statusSignals = []os.Signal{syscall.SIGUSR1}
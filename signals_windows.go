@@ -0,0 +1,7 @@
+package main
+
+import "os"
+
+// statusSignals are the signals that cause the tailer table to be printed.
+// Windows has no equivalent of SIGUSR1.
+var statusSignals []os.Signal
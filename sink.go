@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jpillora/backoff"
+)
+
+// Number of times a sink tries to send a batch before giving up.
+const sinkMaxAttempts = 10
+
+// sinkBackoff is how long a sink waits between attempts.
+var sinkBackoff = backoff.Backoff{Min: 500 * time.Millisecond, Max: 30 * time.Second}
+
+// Sink sends events somewhere other than the terminal.
+type Sink interface {
+	// OnEvent queues an event. It must not block.
+	OnEvent(event *LogEvent)
+
+	// Close sends any queued events, and stops.
+	Close()
+}
+
+// sinkQueue is a bounded queue of events waiting to be sent by a sink, which
+// are taken off in batches. When the queue is full, the oldest events are
+// dropped, so that a sink that can't keep up never holds up output.
+type sinkQueue struct {
+	name     string
+	events   []LogEvent
+	max      int
+	dropped  int64
+	reported time.Time
+	closed   bool
+	cond     *sync.Cond
+	sync.Mutex
+}
+
+func newSinkQueue(name string, max int) *sinkQueue {
+	q := &sinkQueue{name: name, max: max}
+	q.cond = sync.NewCond(&q.Mutex)
+	return q
+}
+
+// Add queues an event, dropping the oldest one if the queue is full.
+func (q *sinkQueue) Add(event LogEvent) {
+	q.Lock()
+	defer q.Unlock()
+
+	if q.closed {
+		return
+	}
+	if len(q.events) >= q.max {
+		q.events[0] = LogEvent{}
+		q.events = q.events[1:]
+		q.drop(1)
+	}
+	q.events = append(q.events, event)
+	if len(q.events) == 1 || len(q.events) >= q.max {
+		q.cond.Broadcast()
+	}
+}
+
+// Next waits for events, and then for up to wait for more to arrive, and
+// returns at most size of them. It returns false once the queue has been
+// closed and emptied.
+func (q *sinkQueue) Next(size int, wait time.Duration) ([]LogEvent, bool) {
+	q.Lock()
+	defer q.Unlock()
+
+	for len(q.events) == 0 && !q.closed {
+		q.cond.Wait()
+	}
+	if len(q.events) == 0 {
+		return nil, false
+	}
+
+	if len(q.events) < size && !q.closed && wait > 0 {
+		expired := false
+		timer := time.AfterFunc(wait, func() {
+			q.Lock()
+			expired = true
+			q.cond.Broadcast()
+			q.Unlock()
+		})
+		for len(q.events) < size && !q.closed && !expired {
+			q.cond.Wait()
+		}
+		timer.Stop()
+	}
+
+	n := min(size, len(q.events))
+	batch := make([]LogEvent, n)
+	copy(batch, q.events)
+	clear(q.events[:n])
+	q.events = q.events[n:]
+	return batch, true
+}
+
+// Requeue puts events that could not be sent back at the front of the queue.
+func (q *sinkQueue) Requeue(events []LogEvent) {
+	q.Lock()
+	defer q.Unlock()
+
+	q.events = append(events[:len(events):len(events)], q.events...)
+	if n := len(q.events) - q.max; n > 0 {
+		clear(q.events[:n])
+		q.events = q.events[n:]
+		q.drop(n)
+	}
+	q.cond.Broadcast()
+}
+
+// drop counts dropped events, and reports them at most every 10 seconds.
+// Must be called with the lock held.
+func (q *sinkQueue) drop(n int) {
+	q.dropped += int64(n)
+	if time.Since(q.reported) >= 10*time.Second {
+		printError("%s is falling behind; dropped %d lines", q.name, q.dropped)
+		q.dropped = 0
+		q.reported = time.Now()
+	}
+}
+
+// Close stops accepting events. Events already queued can still be taken.
+func (q *sinkQueue) Close() {
+	q.Lock()
+	defer q.Unlock()
+	q.closed = true
+	q.cond.Broadcast()
+}
+
+// postWithRetry posts a JSON body, retrying with backoff when the server
+// can't be reached or asks to try again later.
+func postWithRetry(
+	ctx context.Context,
+	client *http.Client,
+	url string,
+	headers map[string]string,
+	body []byte) error {
+	boff := sinkBackoff
+	for attempt := 1; ; attempt++ {
+		err := postJSON(ctx, client, url, headers, body)
+		if err == nil {
+			return nil
+		}
+		var statusErr *sinkStatusError
+		if attempt == sinkMaxAttempts || (errors.As(err, &statusErr) && !statusErr.retryable()) ||
+			!sleep(ctx, boff.Duration()) {
+			return err
+		}
+	}
+}
+
+func postJSON(ctx context.Context, client *http.Client, url string, headers map[string]string, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return &sinkStatusError{status: resp.Status, code: resp.StatusCode, message: strings.TrimSpace(string(b))}
+	}
+	return nil
+}
+
+type sinkStatusError struct {
+	status  string
+	code    int
+	message string
+}
+
+func (e *sinkStatusError) Error() string {
+	return fmt.Sprintf("server returned %s: %s", e.status, e.message)
+}
+
+// retryable returns whether the request might succeed if sent again.
+func (e *sinkStatusError) retryable() bool {
+	return e.code == http.StatusTooManyRequests || e.code >= 500
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// sinkRequest is a request received by a sinkReceiver.
+type sinkRequest struct {
+	header http.Header
+	body   []byte
+}
+
+// sinkReceiver is a server that records the requests posted to it, and
+// responds to them with the given statuses in turn, and then with 200.
+type sinkReceiver struct {
+	*httptest.Server
+	requests chan sinkRequest
+	statuses []int
+	sync.Mutex
+}
+
+func newSinkReceiver(t *testing.T, statuses ...int) *sinkReceiver {
+	r := &sinkReceiver{requests: make(chan sinkRequest, 100), statuses: statuses}
+	r.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, err := io.ReadAll(req.Body)
+		if err != nil {
+			t.Errorf("could not read body: %s", err)
+		}
+		r.requests <- sinkRequest{header: req.Header, body: body}
+
+		r.Lock()
+		status := http.StatusOK
+		if len(r.statuses) > 0 {
+			status, r.statuses = r.statuses[0], r.statuses[1:]
+		}
+		r.Unlock()
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(r.Close)
+	return r
+}
+
+func (r *sinkReceiver) next(t *testing.T) sinkRequest {
+	t.Helper()
+	select {
+	case req := <-r.requests:
+		return req
+	case <-time.After(5 * time.Second):
+		t.Fatal("no request received")
+		return sinkRequest{}
+	}
+}
+
+// count returns the number of requests received so far.
+func (r *sinkReceiver) count() int {
+	return len(r.requests)
+}
+
+// useFastSinkBackoff makes sinks retry without waiting long.
+func useFastSinkBackoff(t *testing.T) {
+	saved := sinkBackoff
+	sinkBackoff.Min, sinkBackoff.Max = time.Millisecond, time.Millisecond
+	t.Cleanup(func() {
+		sinkBackoff = saved
+	})
+}
+
+func TestPostWithRetry(t *testing.T) {
+	useFastSinkBackoff(t)
+
+	for _, tc := range []struct {
+		name     string
+		statuses []int
+		attempts int
+		ok       bool
+	}{
+		{name: "success", attempts: 1, ok: true},
+		{name: "retry on server error", statuses: []int{500, 503}, attempts: 3, ok: true},
+		{name: "retry when rate limited", statuses: []int{429}, attempts: 2, ok: true},
+		{name: "drop on client error", statuses: []int{400}, attempts: 1},
+		{name: "drop after a retry", statuses: []int{502, 413}, attempts: 2},
+		{name: "give up", statuses: []int{500, 500, 500, 500, 500, 500, 500, 500, 500, 500, 500},
+			attempts: sinkMaxAttempts},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := newSinkReceiver(t, tc.statuses...)
+			err := postWithRetry(context.Background(), http.DefaultClient, r.URL,
+				map[string]string{"X-Test": "yes"}, []byte(`{"a":1}`))
+			if (err == nil) != tc.ok {
+				t.Errorf("got error %v", err)
+			}
+			if r.count() != tc.attempts {
+				t.Errorf("got %d attempts, expected %d", r.count(), tc.attempts)
+			}
+			req := r.next(t)
+			if string(req.body) != `{"a":1}` || req.header.Get("X-Test") != "yes" ||
+				req.header.Get("Content-Type") != "application/json" {
+				t.Errorf("got request %+v", req)
+			}
+		})
+	}
+}
+
+func TestSinkQueueReportsDrops(t *testing.T) {
+	messages := captureMessages(t)
+	q := newSinkQueue("Test", 3)
+	pod := newTestPod("default", "web")
+	for _, message := range []string{"one", "two", "three", "four"} {
+		q.Add(*newTestLogEvent(pod, time.Now(), message))
+	}
+	if !strings.Contains(messages.String(), "Test is falling behind; dropped 1 lines") {
+		t.Errorf("got messages %q", messages.String())
+	}
+
+	// Events that could not be sent are dropped too, when new ones have
+	// taken their place, and reported with the next notice
+	batch, _ := q.Next(2, 0)
+	q.Add(*newTestLogEvent(pod, time.Now(), "five"))
+	q.Add(*newTestLogEvent(pod, time.Now(), "six"))
+	q.Requeue(batch)
+	if q.dropped != 2 {
+		t.Errorf("got %d unreported drops", q.dropped)
+	}
+	q.reported = time.Time{}
+	q.Add(*newTestLogEvent(pod, time.Now(), "seven"))
+	if !strings.Contains(messages.String(), "dropped 3 lines") {
+		t.Errorf("got messages %q", messages.String())
+	}
+
+	batch, _ = q.Next(10, 0)
+	var got []string
+	for _, event := range batch {
+		got = append(got, event.Message)
+	}
+	if strings.Join(got, ",") != "five,six,seven" {
+		t.Errorf("got queued %v", got)
+	}
+}
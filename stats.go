@@ -0,0 +1,238 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+type containerStats struct {
+	namespace string
+	pod       string
+	container string
+	lines     int64
+	bytes     int64
+	levels    map[LogLevel]int64
+	lastSeen  time.Time
+	entered   bool // Appeared after ktail was started
+	left      bool
+}
+
+// ContainerStatsSnapshot is a copy of the statistics for a single container.
+type ContainerStatsSnapshot struct {
+	Namespace string
+	Pod       string
+	Container string
+	Lines     int64
+	Bytes     int64
+	Errors    int64
+	Warnings  int64
+	LastSeen  time.Time
+	Left      bool
+}
+
+// Stats collects statistics about the session, for printing a summary when
+// ktail exits.
+type Stats struct {
+	started    time.Time
+	containers map[string]*containerStats
+	events     int64
+	first      *time.Time
+	last       *time.Time
+	sync.Mutex
+}
+
+func NewStats() *Stats {
+	return &Stats{
+		started:    time.Now(),
+		containers: map[string]*containerStats{},
+	}
+}
+
+func (s *Stats) OnEvent(event *LogEvent) {
+	if event.Kind == LogEventKindEvent {
+		s.Lock()
+		s.events++
+		s.Unlock()
+		return
+	}
+	if event.Kind != LogEventKindLog {
+		return
+	}
+
+	level := event.Level()
+
+	s.Lock()
+	defer s.Unlock()
+
+	cs := s.getContainer(event.Pod, event.Container)
+	cs.lines++
+	cs.bytes += int64(len(event.Message))
+	cs.levels[level]++
+	cs.lastSeen = time.Now()
+
+	if s.first == nil || event.Timestamp.Before(*s.first) {
+		s.first = event.Timestamp
+	}
+	if s.last == nil || event.Timestamp.After(*s.last) {
+		s.last = event.Timestamp
+	}
+}
+
+func (s *Stats) OnEnter(pod *v1.Pod, container *v1.Container, initialAddPhase bool) {
+	s.Lock()
+	defer s.Unlock()
+	cs := s.getContainer(pod, container)
+	if !initialAddPhase {
+		cs.entered = true
+	}
+}
+
+func (s *Stats) OnExit(pod *v1.Pod, container *v1.Container) {
+	s.Lock()
+	defer s.Unlock()
+	s.getContainer(pod, container).left = true
+}
+
+// Snapshot returns the current statistics of every container, keyed by
+// container key.
+func (s *Stats) Snapshot() map[string]ContainerStatsSnapshot {
+	s.Lock()
+	defer s.Unlock()
+
+	result := make(map[string]ContainerStatsSnapshot, len(s.containers))
+	for key, cs := range s.containers {
+		result[key] = ContainerStatsSnapshot{
+			Namespace: cs.namespace,
+			Pod:       cs.pod,
+			Container: cs.container,
+			Lines:     cs.lines,
+			Bytes:     cs.bytes,
+			Errors:    cs.levels[LogLevelError] + cs.levels[LogLevelFatal],
+			Warnings:  cs.levels[LogLevelWarn],
+			LastSeen:  cs.lastSeen,
+			Left:      cs.left,
+		}
+	}
+	return result
+}
+
+func (s *Stats) getContainer(pod *v1.Pod, container *v1.Container) *containerStats {
+	key := buildKey(pod, container)
+	cs, ok := s.containers[key]
+	if !ok {
+		cs = &containerStats{
+			namespace: pod.Namespace,
+			pod:       pod.Name,
+			container: container.Name,
+			levels:    map[LogLevel]int64{},
+		}
+		s.containers[key] = cs
+	}
+	return cs
+}
+
+// PrintSummary prints a table of per-container statistics, followed by
+// totals for the session.
+func (s *Stats) PrintSummary(w io.Writer, tailers []TailerInfo, formatName func(namespace, pod, container string) string) {
+	s.Lock()
+	defer s.Unlock()
+
+	reconnects := map[string]int{}
+	malformed := 0
+	for _, t := range tailers {
+		reconnects[t.Namespace+"/"+t.Pod+"/"+t.Container] = t.Reconnects
+		malformed += t.Malformed
+	}
+
+	keys := make([]string, 0, len(s.containers))
+	for key := range s.containers {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var lines, bytes, errors, warnings int64
+	var entered, left int
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	_, _ = fmt.Fprintln(tw, "CONTAINER\tLINES\tBYTES\tERRORS\tWARNINGS\tRECONNECTS\tLIFECYCLE")
+	for _, key := range keys {
+		cs := s.containers[key]
+		lifecycle := "attached"
+		switch {
+		case cs.entered && cs.left:
+			lifecycle = "entered, left"
+		case cs.entered:
+			lifecycle = "entered"
+		case cs.left:
+			lifecycle = "left"
+		}
+		csErrors := cs.levels[LogLevelError] + cs.levels[LogLevelFatal]
+		csWarnings := cs.levels[LogLevelWarn]
+		_, _ = fmt.Fprintf(tw, "%s\t%d\t%s\t%d\t%d\t%d\t%s\n",
+			formatName(cs.namespace, cs.pod, cs.container), cs.lines, formatBytes(cs.bytes),
+			csErrors, csWarnings, reconnects[key], lifecycle)
+
+		lines += cs.lines
+		bytes += cs.bytes
+		errors += csErrors
+		warnings += csWarnings
+		if cs.entered {
+			entered++
+		}
+		if cs.left {
+			left++
+		}
+	}
+	_ = tw.Flush()
+
+	_, _ = fmt.Fprintf(w, "\n%d lines (%s) from %d containers in %s; %d errors, %d warnings",
+		lines, formatBytes(bytes), len(s.containers), formatDuration(time.Since(s.started)), errors, warnings)
+	if s.events > 0 {
+		_, _ = fmt.Fprintf(w, ", %d Kubernetes events", s.events)
+	}
+	if malformed > 0 {
+		_, _ = fmt.Fprintf(w, ", %d malformed lines", malformed)
+	}
+	_, _ = fmt.Fprintf(w, "\n%d containers entered, %d left\n", entered, left)
+	if s.first != nil {
+		_, _ = fmt.Fprintf(w, "Log lines span %s to %s (%s)\n",
+			formatTimestamp(s.first), formatTimestamp(s.last), formatDuration(s.last.Sub(*s.first)))
+	}
+}
+
+// PrintTailers prints the current state of all tailers.
+func PrintTailers(w io.Writer, tailers []TailerInfo, formatName func(namespace, pod, container string) string) {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	_, _ = fmt.Fprintln(tw, "CONTAINER\tSTATE\tLAST LINE\tBACKOFF\tRECONNECTS\tMALFORMED")
+	for _, t := range tailers {
+		lastLine := "never"
+		if !t.LastLineTime.IsZero() {
+			lastLine = formatDuration(time.Since(t.LastLineTime)) + " ago"
+		}
+		backoff := "-"
+		if t.Phase == TailerPhaseBackoff {
+			backoff = formatDuration(t.Backoff)
+		}
+		_, _ = fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%d\t%d\n",
+			formatName(t.Namespace, t.Pod, t.Container), t.Phase, lastLine, backoff, t.Reconnects, t.Malformed)
+	}
+	_ = tw.Flush()
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
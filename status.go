@@ -0,0 +1,147 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+// ContainerExitStatus describes the state of a container at the time it
+// stopped being tailed or terminated.
+type ContainerExitStatus struct {
+	State           string                `json:"state"`
+	Reason          string                `json:"reason,omitempty"`
+	Message         string                `json:"message,omitempty"`
+	RestartCount    int32                 `json:"restartCount"`
+	StartedAt       *time.Time            `json:"startedAt,omitempty"`
+	Termination     *ContainerTermination `json:"termination,omitempty"`
+	LastTermination *ContainerTermination `json:"lastTermination,omitempty"`
+}
+
+type ContainerTermination struct {
+	Reason          string    `json:"reason,omitempty"`
+	ExitCode        int32     `json:"exitCode"`
+	Signal          int32     `json:"signal,omitempty"`
+	Message         string    `json:"message,omitempty"`
+	StartedAt       time.Time `json:"startedAt"`
+	FinishedAt      time.Time `json:"finishedAt"`
+	DurationSeconds float64   `json:"durationSeconds"`
+}
+
+func getContainerExitStatus(pod *v1.Pod, container *v1.Container) *ContainerExitStatus {
+	status := &ContainerExitStatus{State: "unknown"}
+	for _, cs := range allContainerStatusesForPod(pod) {
+		if cs.Name != container.Name {
+			continue
+		}
+		status.RestartCount = cs.RestartCount
+		switch {
+		case cs.State.Running != nil:
+			status.State = "running"
+			startedAt := cs.State.Running.StartedAt.Time
+			status.StartedAt = &startedAt
+		case cs.State.Waiting != nil:
+			status.State = "waiting"
+			status.Reason = cs.State.Waiting.Reason
+			status.Message = strings.TrimSpace(cs.State.Waiting.Message)
+		case cs.State.Terminated != nil:
+			status.State = "terminated"
+			status.Reason = cs.State.Terminated.Reason
+			status.Termination = newContainerTermination(cs.State.Terminated)
+		}
+		if status.Termination == nil && cs.LastTerminationState.Terminated != nil {
+			status.LastTermination = newContainerTermination(cs.LastTerminationState.Terminated)
+		}
+		break
+	}
+	return status
+}
+
+func newContainerTermination(state *v1.ContainerStateTerminated) *ContainerTermination {
+	t := &ContainerTermination{
+		Reason:     state.Reason,
+		ExitCode:   state.ExitCode,
+		Signal:     state.Signal,
+		Message:    strings.TrimSpace(state.Message),
+		StartedAt:  state.StartedAt.Time,
+		FinishedAt: state.FinishedAt.Time,
+	}
+	if !t.StartedAt.IsZero() && t.FinishedAt.After(t.StartedAt) {
+		t.DurationSeconds = t.FinishedAt.Sub(t.StartedAt).Seconds()
+	}
+	return t
+}
+
+// String returns a human-readable summary such as
+// "terminated: OOMKilled, exit code 137, ran 2m3s, 4 restarts".
+func (s *ContainerExitStatus) String() string {
+	parts := []string{}
+	if s.Reason != "" {
+		parts = append(parts, s.Reason)
+	}
+	if s.Termination != nil {
+		parts = append(parts, s.Termination.details()...)
+	} else if s.StartedAt != nil {
+		parts = append(parts, fmt.Sprintf("ran %s", formatDuration(time.Since(*s.StartedAt))))
+	}
+	if s.RestartCount == 1 {
+		parts = append(parts, "1 restart")
+	} else if s.RestartCount > 1 {
+		parts = append(parts, fmt.Sprintf("%d restarts", s.RestartCount))
+	}
+
+	result := s.State
+	if len(parts) > 0 {
+		result += ": " + strings.Join(parts, ", ")
+	}
+	if s.LastTermination != nil {
+		last := s.LastTermination.details()
+		if s.LastTermination.Reason != "" {
+			last = append([]string{s.LastTermination.Reason}, last...)
+		}
+		result += "; last exit: " + strings.Join(last, ", ")
+	}
+
+	message := s.Message
+	if s.Termination != nil {
+		message = s.Termination.Message
+	} else if s.LastTermination != nil && message == "" {
+		message = s.LastTermination.Message
+	}
+	if message != "" {
+		result += ": " + message
+	}
+	return result
+}
+
+func (t *ContainerTermination) details() []string {
+	parts := []string{fmt.Sprintf("exit code %d", t.ExitCode)}
+	if t.Signal != 0 {
+		parts = append(parts, fmt.Sprintf("signal %d", t.Signal))
+	}
+	if t.DurationSeconds > 0 {
+		parts = append(parts, fmt.Sprintf("ran %s",
+			formatDuration(time.Duration(t.DurationSeconds*float64(time.Second)))))
+	}
+	return parts
+}
+
+func formatDuration(d time.Duration) string {
+	if d >= time.Minute {
+		return d.Round(time.Second).String()
+	}
+	return d.Round(time.Millisecond).String()
+}
+
+// containerTerminated returns true if a container status update indicates
+// that the container has terminated since the previous status. Crashing
+// containers often go straight to waiting with a higher restart count, so
+// that is treated as a termination, too.
+func containerTerminated(old, new *v1.ContainerStatus) bool {
+	if old.State.Terminated != nil {
+		return false
+	}
+	return new.State.Terminated != nil || new.RestartCount > old.RestartCount
+}
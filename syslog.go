@@ -0,0 +1,351 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+	"unicode/utf8"
+
+	"github.com/jpillora/backoff"
+)
+
+// IDs of the structured data elements for the namespace and the pod labels.
+// 32473 is the private enterprise number reserved for examples (RFC 5612).
+const (
+	syslogSDID       = "k8s@32473"
+	syslogLabelsSDID = "k8s-labels@32473"
+)
+
+// Limits of the maximum message size: the header always fits in the
+// smallest, and the largest is that of a UDP datagram sent over IPv4.
+const (
+	syslogMinSize    = 1024
+	syslogMaxUDPSize = 65507
+)
+
+var syslogFacilities = map[string]int{
+	"kern": 0, "user": 1, "mail": 2, "daemon": 3, "auth": 4, "syslog": 5, "lpr": 6, "news": 7,
+	"uucp": 8, "cron": 9, "authpriv": 10, "ftp": 11,
+	"local0": 16, "local1": 17, "local2": 18, "local3": 19,
+	"local4": 20, "local5": 21, "local6": 22, "local7": 23,
+}
+
+func parseSyslogFacility(s string) (int, error) {
+	if f, ok := syslogFacilities[s]; ok {
+		return f, nil
+	}
+	return 0, fmt.Errorf("invalid syslog facility %q (must be one of user, daemon, local0 to local7 and so on)", s)
+}
+
+// syslogSeverity maps a log level to a syslog severity.
+func syslogSeverity(level LogLevel) int {
+	switch level {
+	case LogLevelFatal:
+		return 2 // Critical
+	case LogLevelError:
+		return 3 // Error
+	case LogLevelWarn:
+		return 4 // Warning
+	case LogLevelTrace, LogLevelDebug:
+		return 7 // Debug
+	default:
+		return 6 // Informational
+	}
+}
+
+// SyslogSinkOptions configures a SyslogSink.
+type SyslogSinkOptions struct {
+	// Where to send messages, such as udp://host:514, tcp://host:601 or
+	// tls://host:6514.
+	Address string
+
+	Facility int
+
+	// File with CA certificates to verify the server with TLS. If empty, the
+	// system's CA certificates are used.
+	CAFile string
+
+	// Maximum size of a message in bytes, not counting the framing. Longer
+	// messages are truncated.
+	MaxSize int
+
+	// Maximum number of messages waiting to be sent.
+	BufferSize int
+}
+
+// SyslogSink sends log lines as RFC 5424 syslog messages over UDP, TCP or TLS.
+// Over TCP and TLS, messages are framed by octet counting (RFC 6587).
+type SyslogSink struct {
+	options   SyslogSinkOptions
+	network   string
+	address   string
+	tlsConfig *tls.Config
+	conn      net.Conn
+	queue     *sinkQueue
+	ctx       context.Context
+	cancel    context.CancelFunc
+	done      chan struct{}
+}
+
+func NewSyslogSink(options SyslogSinkOptions) (*SyslogSink, error) {
+	u, err := url.Parse(options.Address)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid syslog address %q: must be udp://, tcp:// or tls:// followed by HOST:PORT",
+			options.Address)
+	}
+
+	s := &SyslogSink{
+		options: options,
+		address: u.Host,
+		queue:   newSinkQueue("Syslog", max(1, options.BufferSize)),
+		done:    make(chan struct{}),
+	}
+	switch u.Scheme {
+	case "udp", "tcp":
+		s.network = u.Scheme
+	case "tls":
+		s.network = "tcp"
+		s.tlsConfig = &tls.Config{ServerName: u.Hostname()}
+		if options.CAFile != "" {
+			pem, err := os.ReadFile(options.CAFile)
+			if err != nil {
+				return nil, err
+			}
+			s.tlsConfig.RootCAs = x509.NewCertPool()
+			if !s.tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("no certificates found in %q", options.CAFile)
+			}
+		}
+	default:
+		return nil, fmt.Errorf("invalid syslog address %q: must be udp://, tcp:// or tls:// followed by HOST:PORT",
+			options.Address)
+	}
+	if _, _, err := net.SplitHostPort(s.address); err != nil {
+		return nil, fmt.Errorf("invalid syslog address %q: %w", options.Address, err)
+	}
+	if options.MaxSize < syslogMinSize {
+		return nil, fmt.Errorf("invalid syslog message size %d: must be at least %d", options.MaxSize, syslogMinSize)
+	}
+	if s.network == "udp" && options.MaxSize > syslogMaxUDPSize {
+		return nil, fmt.Errorf("invalid syslog message size %d: must be at most %d over UDP",
+			options.MaxSize, syslogMaxUDPSize)
+	}
+
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	return s, nil
+}
+
+func (s *SyslogSink) OnEvent(event *LogEvent) {
+	if event.Kind != LogEventKindLog {
+		return
+	}
+	s.queue.Add(*event)
+}
+
+// Run sends messages until the sink is closed.
+func (s *SyslogSink) Run() {
+	defer close(s.done)
+	defer func() {
+		if s.conn != nil {
+			_ = s.conn.Close()
+		}
+	}()
+
+	for {
+		batch, ok := s.queue.Next(100, 0)
+		if !ok {
+			return
+		}
+		for i := range batch {
+			if !s.send(formatSyslogMessage(&batch[i], s.options.Facility, s.options.MaxSize)) {
+				return
+			}
+		}
+	}
+}
+
+// Close sends the messages that are still queued, giving up after a while
+// if the server can't be reached.
+func (s *SyslogSink) Close() {
+	s.queue.Close()
+	select {
+	case <-s.done:
+	case <-time.After(10 * time.Second):
+		s.cancel()
+		<-s.done
+	}
+	s.cancel()
+}
+
+// send writes a message, reconnecting until it succeeds or fails in a way
+// that retrying won't fix, in which case the message is dropped. It returns
+// false if the sink was closed first.
+func (s *SyslogSink) send(msg []byte) bool {
+	if s.network == "tcp" {
+		msg = append([]byte(strconv.Itoa(len(msg))+" "), msg...)
+	}
+
+	boff := &backoff.Backoff{Min: 500 * time.Millisecond, Max: 30 * time.Second}
+	failing := false
+	for {
+		err := s.write(msg)
+		if err == nil {
+			if failing {
+				printInfo("Reconnected to syslog server %s", s.address)
+			}
+			return true
+		}
+		// Always start over with a new connection, as over TCP, part of the
+		// message may have been sent, which would break the framing
+		if s.conn != nil {
+			_ = s.conn.Close()
+			s.conn = nil
+		}
+		if errors.Is(err, syscall.EMSGSIZE) {
+			printError("Could not send to syslog server %s, dropping message: %s", s.address, err)
+			return true
+		}
+		if !failing {
+			printError("Could not send to syslog server %s, will retry: %s", s.address, err)
+			failing = true
+		}
+		if !sleep(s.ctx, boff.Duration()) {
+			return false
+		}
+	}
+}
+
+func (s *SyslogSink) write(msg []byte) error {
+	if s.conn == nil {
+		dialer := &net.Dialer{Timeout: 10 * time.Second}
+		var err error
+		if s.tlsConfig != nil {
+			s.conn, err = (&tls.Dialer{NetDialer: dialer, Config: s.tlsConfig}).DialContext(
+				s.ctx, s.network, s.address)
+		} else {
+			s.conn, err = dialer.DialContext(s.ctx, s.network, s.address)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	_ = s.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	_, err := s.conn.Write(msg)
+	return err
+}
+
+// formatSyslogMessage formats an event as an RFC 5424 message of at most
+// maxSize bytes. The hostname is the node, the app name is the container and
+// the process ID is the pod. Pod labels are left out if they don't fit, and
+// the log message is truncated if it doesn't.
+func formatSyslogMessage(event *LogEvent, facility int, maxSize int) []byte {
+	timestamp := time.Now()
+	if event.Timestamp != nil {
+		timestamp = *event.Timestamp
+	}
+	container := ""
+	if event.Container != nil {
+		container = event.Container.Name
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "<%d>1 %s %s %s %s - ",
+		facility*8+syslogSeverity(event.Level()),
+		timestamp.UTC().Format("2006-01-02T15:04:05.000000Z"),
+		syslogHeaderField(event.Pod.Spec.NodeName, 255),
+		syslogHeaderField(container, 48),
+		syslogHeaderField(event.Pod.Name, 128))
+
+	b.WriteString("[" + syslogSDID + ` namespace="` + escapeSyslogParam(event.Pod.Namespace) + `"]`)
+	var labels strings.Builder
+	if len(event.Pod.Labels) > 0 {
+		names := make([]string, 0, len(event.Pod.Labels))
+		for name := range event.Pod.Labels {
+			if isSyslogName(name) {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+		if len(names) > 0 {
+			labels.WriteString("[" + syslogLabelsSDID)
+			for _, name := range names {
+				labels.WriteString(" " + name + `="` + escapeSyslogParam(event.Pod.Labels[name]) + `"`)
+			}
+			labels.WriteString("]")
+		}
+	}
+	if b.Len()+labels.Len() < maxSize {
+		b.WriteString(labels.String())
+	}
+
+	b.WriteString(" " + strings.TrimRight(event.Message, "\r\n"))
+	return truncateUTF8([]byte(b.String()), maxSize)
+}
+
+// truncateUTF8 truncates a string of bytes to at most n bytes, without
+// splitting a UTF-8 sequence.
+func truncateUTF8(b []byte, n int) []byte {
+	if len(b) <= n {
+		return b
+	}
+	b = b[:n]
+	for i := 0; i < utf8.UTFMax && i < len(b); i++ {
+		r, size := utf8.DecodeLastRune(b)
+		if r != utf8.RuneError || size != 1 {
+			break
+		}
+		b = b[:len(b)-1]
+	}
+	return b
+}
+
+// syslogHeaderField returns a header field, which must be printable ASCII
+// without spaces, or "-" if empty.
+func syslogHeaderField(s string, maxLen int) string {
+	s = strings.Map(func(r rune) rune {
+		if r <= ' ' || r > '~' {
+			return '_'
+		}
+		return r
+	}, s)
+	if s == "" {
+		return "-"
+	}
+	if len(s) > maxLen {
+		s = s[:maxLen]
+	}
+	return s
+}
+
+// isSyslogName returns whether a name is valid as a structured data
+// parameter name.
+func isSyslogName(s string) bool {
+	if s == "" || len(s) > 32 {
+		return false
+	}
+	for _, r := range s {
+		if r <= ' ' || r > '~' || r == '=' || r == ']' || r == '"' {
+			return false
+		}
+	}
+	return true
+}
+
+var syslogParamReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`)
+
+func escapeSyslogParam(s string) string {
+	if !utf8.ValidString(s) {
+		s = strings.ToValidUTF8(s, "�")
+	}
+	return syslogParamReplacer.Replace(s)
+}
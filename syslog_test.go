@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+func TestFormatSyslogMessage(t *testing.T) {
+	pod := newTestPod("default", "web")
+	timestamp := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	header := `<14>1 2024-05-01T12:00:00.000000Z node-1 app web - [k8s@32473 namespace="default"]`
+	labels := `[k8s-labels@32473 app="web"]`
+
+	for _, tc := range []struct {
+		name     string
+		message  string
+		maxSize  int
+		expected string
+	}{
+		{
+			name:     "fits",
+			message:  "error: failed\n",
+			maxSize:  1024,
+			expected: header + labels + " error: failed",
+		},
+		{
+			name:     "truncated",
+			message:  "error: " + strings.Repeat("x", 100),
+			maxSize:  len(header+labels) + 20,
+			expected: header + labels + " error: " + strings.Repeat("x", 12),
+		},
+		{
+			name:     "truncated without splitting a character",
+			message:  "error: ééé",
+			maxSize:  len(header+labels) + 11,
+			expected: header + labels + " error: é",
+		},
+		{
+			name:     "labels left out",
+			message:  "error: failed",
+			maxSize:  len(header) + 10,
+			expected: header + " error: fa",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			msg := formatSyslogMessage(newTestLogEvent(pod, timestamp, tc.message), 1, tc.maxSize)
+			if string(msg) != tc.expected {
+				t.Errorf("got %q, expected %q", msg, tc.expected)
+			}
+			if len(msg) > tc.maxSize || !utf8.Valid(msg) {
+				t.Errorf("got %d bytes, or invalid UTF-8", len(msg))
+			}
+		})
+	}
+}
+
+func TestNewSyslogSinkMaxSize(t *testing.T) {
+	for _, tc := range []struct {
+		address string
+		maxSize int
+		ok      bool
+	}{
+		{"udp://localhost:514", 2048, true},
+		{"udp://localhost:514", 65507, true},
+		{"udp://localhost:514", 65508, false},
+		{"tcp://localhost:601", 100000, true},
+		{"tcp://localhost:601", 100, false},
+	} {
+		_, err := NewSyslogSink(SyslogSinkOptions{Address: tc.address, MaxSize: tc.maxSize})
+		if (err == nil) != tc.ok {
+			t.Errorf("%s with size %d: got error %v", tc.address, tc.maxSize, err)
+		}
+	}
+}
+
+// brokenConn is a connection that sends part of a message and then fails.
+type brokenConn struct {
+	net.Conn
+	err    error
+	closed bool
+}
+
+func (c *brokenConn) Write(b []byte) (int, error) {
+	return len(b) / 2, c.err
+}
+
+func (c *brokenConn) SetWriteDeadline(time.Time) error {
+	return nil
+}
+
+func (c *brokenConn) Close() error {
+	c.closed = true
+	return nil
+}
+
+func TestSyslogSinkSend(t *testing.T) {
+	useFastSinkBackoff(t)
+
+	for _, tc := range []struct {
+		name     string
+		err      error
+		received bool
+	}{
+		{name: "resent on a new connection", err: errors.New("connection reset"), received: true},
+		{name: "dropped if too long", err: &net.OpError{Op: "write", Err: syscall.EMSGSIZE}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			listener, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer func() {
+				_ = listener.Close()
+			}()
+			received := make(chan string, 1)
+			go func() {
+				conn, err := listener.Accept()
+				if err != nil {
+					return
+				}
+				defer func() {
+					_ = conn.Close()
+				}()
+				var length int
+				r := bufio.NewReader(conn)
+				if _, err := fmt.Fscanf(r, "%d ", &length); err != nil {
+					t.Errorf("invalid framing: %s", err)
+					return
+				}
+				msg := make([]byte, length)
+				if _, err := r.Read(msg); err != nil {
+					t.Errorf("could not read message: %s", err)
+				}
+				received <- string(msg)
+			}()
+
+			s, err := NewSyslogSink(SyslogSinkOptions{
+				Address: "tcp://" + listener.Addr().String(),
+				MaxSize: 2048,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			broken := &brokenConn{err: tc.err}
+			s.conn = broken
+			if !s.send([]byte("hello")) {
+				t.Fatal("sink was closed")
+			}
+			if !broken.closed {
+				t.Errorf("failed connection was not closed")
+			}
+
+			select {
+			case msg := <-received:
+				if !tc.received || msg != "hello" {
+					t.Errorf("received %q", msg)
+				}
+			case <-time.After(500 * time.Millisecond):
+				if tc.received {
+					t.Errorf("nothing received")
+				}
+			}
+			if s.conn != nil {
+				_ = s.conn.Close()
+			}
+		})
+	}
+}
@@ -2,13 +2,13 @@ package main
 
 import (
 	"bufio"
-	"bytes"
 	"context"
 	"crypto/sha256"
+	goerrors "errors"
 	"io"
 	"net/http"
 	"strings"
-	"sync/atomic"
+	"sync"
 	"time"
 
 	"github.com/jpillora/backoff"
@@ -25,73 +25,412 @@ const (
 	tailStateRecover
 )
 
+// TailerPhase describes what a tailer is currently doing.
+type TailerPhase string
+
+const (
+	TailerPhaseWaiting    TailerPhase = "waiting for slot"
+	TailerPhaseConnecting TailerPhase = "connecting"
+	TailerPhaseStreaming  TailerPhase = "streaming"
+	TailerPhaseBackoff    TailerPhase = "backoff"
+	TailerPhaseStopped    TailerPhase = "stopped"
+)
+
+// ContainerTailerStatus is a snapshot of a tailer's progress.
+type ContainerTailerStatus struct {
+	Phase        TailerPhase
+	LastLineTime time.Time // When the last line was received
+	Reconnects   int
+	Backoff      time.Duration // Current delay when in TailerPhaseBackoff
+	Malformed    int           // Number of lines that could not be parsed
+}
+
+type LogEventKind string
+
+const (
+	// LogEventKindLog is a line read from a container's log.
+	LogEventKindLog LogEventKind = "log"
+
+	// LogEventKindEvent is a Kubernetes event about a pod or one of its containers.
+	LogEventKindEvent LogEventKind = "event"
+
+	// LogEventKindExit is a container leaving or terminating.
+	LogEventKindExit LogEventKind = "exit"
+)
+
 type LogEvent struct {
+	Kind      LogEventKind
 	Pod       *v1.Pod
-	Container *v1.Container
+	Container *v1.Container // May be nil for events that concern the whole pod
 	Timestamp *time.Time
 	Message   string
+	Event     *v1.Event            // Only set for LogEventKindEvent
+	Exit      *ContainerExitStatus // Only set for LogEventKindExit
+
+	level         LogLevel // Cached by Level
+	levelDetected bool
+
+	// Called once the line has been output, so that the tailer can resume
+	// after it. Only set for lines read from a container's log.
+	onOutput func()
 }
 
 type LogEventFunc func(LogEvent)
 
+// ContainerTailerOptions configures a ContainerTailer.
+type ContainerTailerOptions struct {
+	// Where to start reading the log; nil means from the beginning.
+	FromTimestamp *time.Time
+
+	// If not zero, reconnect when no lines have been received for this long.
+	IdleTimeout time.Duration
+
+	// Emit lines without a valid timestamp, using the time they were received,
+	// instead of dropping them.
+	PassMalformed bool
+
+	// If set, resume where a previous tailer left off; overrides FromTimestamp.
+	Checkpoint *TailerCheckpoint
+
+	// If set, limits the number of streams open at the same time.
+	Scheduler *StreamScheduler
+}
+
+type ContainerTailerCallbacks struct {
+	OnEvent LogEventFunc
+
+	// OnGap is called when lines between two timestamps were probably lost.
+	OnGap func(from, to time.Time)
+
+	// OnMalformed is called for each line that could not be parsed, with the
+	// number of such lines so far.
+	OnMalformed func(line string, count int)
+}
+
+// maxPartialLineSize is the maximum size of a line re-joined from partial
+// lines; larger lines are emitted in pieces.
+const maxPartialLineSize = 1024 * 1024
+
+var (
+	// errStreamIdle is the cause of a stream being cancelled by the watchdog.
+	errStreamIdle = goerrors.New("no output received before idle timeout")
+
+	// errStreamPreempted is the cause of a stream being cancelled to give its
+	// slot to another tailer.
+	errStreamPreempted = goerrors.New("preempted")
+)
+
+// NewContainerTailer creates a tailer. The tailer stops when the context is
+// cancelled or when Stop is called.
 func NewContainerTailer(
+	ctx context.Context,
 	client kubernetes.Interface,
 	pod v1.Pod,
 	container v1.Container,
-	eventFunc LogEventFunc,
-	fromTimestamp *time.Time) *ContainerTailer {
-	return &ContainerTailer{
+	options ContainerTailerOptions,
+	callbacks ContainerTailerCallbacks) *ContainerTailer {
+	ctx, cancel := context.WithCancel(ctx)
+	ct := &ContainerTailer{
+		ctx:           ctx,
+		cancel:        cancel,
 		client:        client,
 		pod:           pod,
 		container:     container,
-		eventFunc:     eventFunc,
-		fromTimestamp: fromTimestamp,
+		callbacks:     callbacks,
+		fromTimestamp: options.FromTimestamp,
+		startFrom:     options.FromTimestamp,
+		idleTimeout:   options.IdleTimeout,
+		passMalformed: options.PassMalformed,
+		scheduler:     options.Scheduler,
 		errorBackoff:  &backoff.Backoff{},
 		state:         tailStateNormal,
+		status:        ContainerTailerStatus{Phase: TailerPhaseConnecting},
 	}
+	ct.openStream = ct.getStream
+	if cp := options.Checkpoint; cp != nil {
+		ct.window = cp.window()
+		ct.lastLine = cp.LastLine
+		ct.output = cp.window()
+		ct.lastOutput = cp.LastLine
+		ct.fromTimestamp = &ct.lastLine
+		ct.startRecovery()
+	}
+	return ct
 }
 
 type ContainerTailer struct {
-	client           kubernetes.Interface
-	pod              v1.Pod
-	container        v1.Container
-	stop             atomic.Bool
-	eventFunc        LogEventFunc
-	fromTimestamp    *time.Time
-	errorBackoff     *backoff.Backoff
-	lastLineChecksum []byte
-	state            tailState
+	ctx           context.Context
+	cancel        context.CancelFunc
+	client        kubernetes.Interface
+	pod           v1.Pod
+	container     v1.Container
+	callbacks     ContainerTailerCallbacks
+	fromTimestamp *time.Time
+	startFrom     *time.Time
+	idleTimeout   time.Duration
+	passMalformed bool
+	scheduler     *StreamScheduler
+	errorBackoff  *backoff.Backoff
+	state         tailState
+	status        ContainerTailerStatus
+	statusLock    sync.Mutex
+
+	// Opens the log stream from fromTimestamp; replaced in tests
+	openStream func(ctx context.Context) (io.ReadCloser, error)
+
+	// The lines received within the second of the last line's timestamp,
+	// and, while recovering, the ones that may still be replayed. Lines are
+	// counted, since a container may log the same line twice at once.
+	window      lineWindow
+	replay      lineWindow
+	lastLine    time.Time
+	recoverTill time.Time
+
+	// Like window and lastLine, but for the lines that have been output,
+	// which may lag behind the ones received
+	output     lineWindow
+	lastOutput time.Time
+	outputLock sync.Mutex
+
+	// Lines that the container runtime split into pieces, being re-joined,
+	// keyed by stream (stdout or stderr)
+	partials map[string]*partialLine
+}
+
+type partialLine struct {
+	timestamp time.Time
+	message   strings.Builder
+	keys      []lineKey
+}
+
+// lineKey identifies a line by its exact timestamp and checksum.
+type lineKey struct {
+	timestamp int64
+	checksum  [sha256.Size]byte
+}
+
+// lineWindow counts the lines received from a given second onwards.
+type lineWindow struct {
+	start time.Time
+	lines map[lineKey]int
+}
+
+func (w *lineWindow) add(key lineKey, timestamp time.Time) {
+	if start := timestamp.Truncate(time.Second); w.lines == nil || start.After(w.start) {
+		w.start = start
+		w.lines = map[lineKey]int{}
+	}
+	w.lines[key]++
+}
+
+// take removes one occurrence of a line, returning false if there is none.
+func (w *lineWindow) take(key lineKey) bool {
+	if w.lines[key] == 0 {
+		return false
+	}
+	w.lines[key]--
+	return true
+}
+
+// remaining returns the number of lines that have not been taken.
+func (w *lineWindow) remaining() int {
+	n := 0
+	for _, count := range w.lines {
+		n += count
+	}
+	return n
 }
 
+func (w *lineWindow) clone() lineWindow {
+	lines := make(map[lineKey]int, len(w.lines))
+	for key, n := range w.lines {
+		lines[key] = n
+	}
+	return lineWindow{start: w.start, lines: lines}
+}
+
+// Stop stops the tailer, closing the log stream immediately. It does not
+// wait for Run to return.
 func (ct *ContainerTailer) Stop() {
-	ct.stop.Store(true)
+	ct.cancel()
+}
+
+// Status returns a snapshot of the tailer's current status. It is safe to
+// call from any goroutine.
+func (ct *ContainerTailer) Status() ContainerTailerStatus {
+	ct.statusLock.Lock()
+	defer ct.statusLock.Unlock()
+	return ct.status
+}
+
+// Checkpoint returns the position of the last line that has been output,
+// from which a new tailer can resume without losing or repeating lines. It
+// returns nil if the tailer reads from the beginning of the log and nothing
+// has been output yet. It is safe to call from any goroutine.
+func (ct *ContainerTailer) Checkpoint() *TailerCheckpoint {
+	ct.outputLock.Lock()
+	defer ct.outputLock.Unlock()
+
+	if ct.lastOutput.IsZero() {
+		if ct.startFrom == nil {
+			return nil
+		}
+		return &TailerCheckpoint{LastLine: *ct.startFrom}
+	}
+	return newTailerCheckpoint(ct.lastOutput, &ct.output)
+}
+
+// markOutput records that the lines with the given keys have been output.
+func (ct *ContainerTailer) markOutput(keys []lineKey) {
+	ct.outputLock.Lock()
+	defer ct.outputLock.Unlock()
+
+	for _, key := range keys {
+		timestamp := time.Unix(0, key.timestamp)
+		ct.output.add(key, timestamp)
+		if timestamp.After(ct.lastOutput) {
+			ct.lastOutput = timestamp
+		}
+	}
+}
+
+func (ct *ContainerTailer) updateStatus(f func(status *ContainerTailerStatus)) {
+	ct.statusLock.Lock()
+	defer ct.statusLock.Unlock()
+	f(&ct.status)
 }
 
-func (ct *ContainerTailer) Run(ctx context.Context, onError func(err error)) {
+func (ct *ContainerTailer) Run(onError func(err error)) {
+	defer ct.cancel()
+	defer ct.updateStatus(func(status *ContainerTailerStatus) {
+		status.Phase = TailerPhaseStopped
+	})
+	// Partial lines are kept across reconnects, as the pieces that follow are
+	// not replayed, but the rest of a line will never come once the tailer
+	// stops
+	defer ct.flushPartials()
+	if ct.scheduler != nil {
+		defer ct.scheduler.Forget(ct)
+	}
+
+	ctx := ct.ctx
 	ct.errorBackoff.Reset()
-	for !ct.stop.Load() {
-		stream, err := ct.getStream(ctx)
+	for first := true; ctx.Err() == nil; first = false {
+		ct.updateStatus(func(status *ContainerTailerStatus) {
+			status.Phase = TailerPhaseConnecting
+			if !first {
+				status.Reconnects++
+			}
+		})
+		streamCtx, cancelStream := context.WithCancelCause(ctx)
+		// Whether the stream was deliberately cut short, to be reconnected
+		interrupted := func() bool {
+			cause := context.Cause(streamCtx)
+			return cause == errStreamIdle || cause == errStreamPreempted
+		}
+
+		if !ct.acquireSlot(func() {
+			cancelStream(errStreamPreempted)
+		}) {
+			cancelStream(nil)
+			break
+		}
+		stream, err := ct.openStream(streamCtx)
+		if ctx.Err() != nil {
+			cancelStream(nil)
+			ct.releaseSlot()
+			break
+		}
 		if err != nil {
-			time.Sleep(ct.errorBackoff.Duration())
-			onError(err)
+			cancelStream(nil)
+			ct.releaseSlot()
+			if !interrupted() {
+				ct.sleepBackoff(ctx)
+				onError(err)
+			}
 			continue
 		}
 		if stream == nil {
+			cancelStream(nil)
+			ct.releaseSlot()
 			break
 		}
-		if err := ct.runStream(stream); err != nil {
+		ct.updateStatus(func(status *ContainerTailerStatus) {
+			status.Phase = TailerPhaseStreaming
+		})
+		err = ct.runStream(stream, func() {
+			cancelStream(errStreamIdle)
+		})
+		wasInterrupted := interrupted()
+		cancelStream(nil)
+		ct.releaseSlot()
+		if err != nil && ctx.Err() == nil && !wasInterrupted {
 			onError(err)
-			time.Sleep(ct.errorBackoff.Duration())
+			ct.sleepBackoff(ctx)
 		}
-		ct.state = tailStateRecover
+		ct.startRecovery()
+	}
+}
+
+// acquireSlot waits for a stream slot, if the number of streams is limited.
+// It returns false if the tailer was stopped while waiting.
+func (ct *ContainerTailer) acquireSlot(preempt func()) bool {
+	if ct.scheduler == nil {
+		return true
 	}
+	ct.updateStatus(func(status *ContainerTailerStatus) {
+		status.Phase = TailerPhaseWaiting
+	})
+	if !ct.scheduler.Acquire(ct.ctx, ct, preempt) {
+		return false
+	}
+	ct.updateStatus(func(status *ContainerTailerStatus) {
+		status.Phase = TailerPhaseConnecting
+	})
+	return true
+}
+
+func (ct *ContainerTailer) releaseSlot() {
+	if ct.scheduler != nil {
+		ct.scheduler.Release(ct)
+	}
+}
+
+// startRecovery prepares for reconnecting. Because the API server only
+// resumes at whole seconds, the new stream may replay lines that have already
+// been received; these are suppressed by receiveLine.
+func (ct *ContainerTailer) startRecovery() {
+	if ct.lastLine.IsZero() {
+		return
+	}
+	ct.state = tailStateRecover
+	ct.replay = ct.window.clone()
+	ct.recoverTill = ct.lastLine
+}
+
+func (ct *ContainerTailer) sleepBackoff(ctx context.Context) {
+	delay := ct.errorBackoff.Duration()
+	ct.updateStatus(func(status *ContainerTailerStatus) {
+		status.Phase = TailerPhaseBackoff
+		status.Backoff = delay
+	})
+	sleep(ctx, delay)
 }
 
-func (ct *ContainerTailer) runStream(stream io.ReadCloser) error {
+// runStream reads lines until the stream ends. If the tailer has an idle
+// timeout, onIdle is called when no lines have been received for that long;
+// it is expected to abort the stream.
+func (ct *ContainerTailer) runStream(stream io.ReadCloser, onIdle func()) error {
 	defer func() {
 		_ = stream.Close()
 	}()
 
+	var watchdog *time.Timer
+	if ct.idleTimeout > 0 {
+		watchdog = time.AfterFunc(ct.idleTimeout, onIdle)
+		defer watchdog.Stop()
+	}
+
 	r := bufio.NewReader(stream)
 	for {
 		line, err := r.ReadString('\n')
@@ -101,7 +440,13 @@ func (ct *ContainerTailer) runStream(stream io.ReadCloser) error {
 		if err != nil {
 			return err
 		}
+		if watchdog != nil {
+			watchdog.Reset(ct.idleTimeout)
+		}
 		ct.errorBackoff.Reset()
+		ct.updateStatus(func(status *ContainerTailerStatus) {
+			status.LastLineTime = time.Now()
+		})
 		ct.receiveLine(line)
 	}
 	return nil
@@ -115,49 +460,137 @@ func (ct *ContainerTailer) receiveLine(s string) {
 		s = s[0 : len(s)-1]
 	}
 
-	parts := strings.SplitN(s, " ", 2)
-	if len(parts) < 2 {
-		// TODO: Warn
+	timeString, message, ok := strings.Cut(s, " ")
+	if !ok {
+		ct.receiveMalformed(s)
 		return
 	}
 
-	timeString, message := parts[0], parts[1]
-
-	var timestamp time.Time
-	if t, err := time.Parse(time.RFC3339Nano, timeString); err == nil {
-		timestamp = t
-	} else {
-		// TODO: Warn
+	timestamp, err := time.Parse(time.RFC3339Nano, timeString)
+	if err != nil {
+		ct.receiveMalformed(s)
 		return
 	}
 
-	checksum := checksumLine(message)
+	key := lineKey{timestamp: timestamp.UnixNano(), checksum: checksumLine(message)}
 
 	if ct.state == tailStateRecover {
-		if ct.lastLineChecksum != nil && bytes.Equal(ct.lastLineChecksum, checksum) {
-			// If just restarted, we might be continuing off a timestamp that results in dupes,
-			// so discard the dupes.
+		if timestamp.After(ct.recoverTill) {
+			// Every line received before reconnecting should have been replayed.
+			// If some were not, the log was probably rotated in the meantime, and
+			// lines that were written before the new ones may be missing.
+			if ct.replay.remaining() > 0 {
+				// The rest of a partial line may be among the missing lines
+				ct.flushPartials()
+				if ct.callbacks.OnGap != nil {
+					ct.callbacks.OnGap(ct.recoverTill, timestamp)
+				}
+			}
+			ct.state = tailStateNormal
+			ct.replay = lineWindow{}
+		} else if timestamp.Before(ct.replay.start) || ct.replay.take(key) {
+			// Replay of a line that has already been received
 			return
 		}
-		if ct.fromTimestamp != nil && timestamp.Before(*ct.fromTimestamp) {
-			// We are receiving an old line, skip it
+	}
+
+	ct.window.add(key, timestamp)
+	if timestamp.After(ct.lastLine) {
+		ct.lastLine = timestamp
+	}
+
+	// On restart, resume from this timestamp; replays are suppressed above
+	ct.fromTimestamp = &ct.lastLine
+
+	if stream, tag, content, ok := parseCRIPartial(message); ok && (tag == "P" || ct.partials[stream] != nil) {
+		partial := ct.partials[stream]
+		if partial == nil {
+			partial = &partialLine{timestamp: timestamp}
+			if ct.partials == nil {
+				ct.partials = map[string]*partialLine{}
+			}
+			ct.partials[stream] = partial
+		}
+		partial.message.WriteString(content)
+		partial.keys = append(partial.keys, key)
+		if tag == "P" && partial.message.Len() < maxPartialLineSize {
 			return
 		}
+		delete(ct.partials, stream)
+		ct.emitLine(partial.timestamp, partial.message.String(), partial.keys)
+		return
 	}
 
-	ct.lastLineChecksum = checksum
-	ct.state = tailStateNormal
+	ct.emitLine(timestamp, message, []lineKey{key})
+}
+
+// flushPartials emits the partial lines that are still waiting for the rest
+// of their pieces, oldest first.
+func (ct *ContainerTailer) flushPartials() {
+	for len(ct.partials) > 0 {
+		var oldest string
+		for stream, partial := range ct.partials {
+			if oldest == "" || partial.timestamp.Before(ct.partials[oldest].timestamp) {
+				oldest = stream
+			}
+		}
+		partial := ct.partials[oldest]
+		delete(ct.partials, oldest)
+		ct.emitLine(partial.timestamp, partial.message.String(), partial.keys)
+	}
+}
 
-	// On restart, start from this timestamp. This isn't exact, however.
-	nextTimestamp := timestamp.Add(time.Millisecond * 1)
-	ct.fromTimestamp = &nextTimestamp
+// receiveMalformed handles a line that does not start with a timestamp.
+func (ct *ContainerTailer) receiveMalformed(line string) {
+	var count int
+	ct.updateStatus(func(status *ContainerTailerStatus) {
+		status.Malformed++
+		count = status.Malformed
+	})
+	if ct.callbacks.OnMalformed != nil {
+		ct.callbacks.OnMalformed(line, count)
+	}
+	if ct.passMalformed {
+		// Can't be resumed from, having no timestamp
+		ct.emitLine(time.Now(), line, nil)
+	}
+}
 
-	ct.eventFunc(LogEvent{
+// emitLine emits a line made up of the log lines with the given keys.
+func (ct *ContainerTailer) emitLine(timestamp time.Time, message string, keys []lineKey) {
+	event := LogEvent{
+		Kind:      LogEventKindLog,
 		Pod:       &ct.pod,
 		Container: &ct.container,
 		Timestamp: &timestamp,
-		Message:   parts[1],
-	})
+		Message:   message,
+	}
+	if len(keys) > 0 {
+		event.onOutput = func() {
+			ct.markOutput(keys)
+		}
+	}
+	ct.callbacks.OnEvent(event)
+}
+
+// parseCRIPartial parses a message in the CRI log format, "<stream> <tag>
+// <content>", where the tag is "P" for a partial line, which continues in
+// the next line, and "F" for the final piece of a line. The kubelet normally
+// re-joins partial lines, but some runtimes and log setups pass them through.
+func parseCRIPartial(message string) (stream, tag, content string, ok bool) {
+	stream, rest, ok := strings.Cut(message, " ")
+	if !ok || (stream != "stdout" && stream != "stderr") {
+		return "", "", "", false
+	}
+	tag, content, ok = strings.Cut(rest, " ")
+	if !ok || (tag != "P" && tag != "F") {
+		// A final piece may be empty, in which case there is no trailing space
+		if rest == "F" {
+			return stream, rest, "", true
+		}
+		return "", "", "", false
+	}
+	return stream, tag, content, true
 }
 
 func (ct *ContainerTailer) getStream(ctx context.Context) (io.ReadCloser, error) {
@@ -183,7 +616,9 @@ func (ct *ContainerTailer) getStream(ctx context.Context) (io.ReadCloser, error)
 			// This will happen if the pod isn't ready for log-reading yet
 			switch status.Status().Code {
 			case http.StatusBadRequest:
-				time.Sleep(boff.Duration())
+				if !sleep(ctx, boff.Duration()) {
+					return nil, ctx.Err()
+				}
 				continue
 			case http.StatusNotFound:
 				return nil, nil
@@ -193,8 +628,19 @@ func (ct *ContainerTailer) getStream(ctx context.Context) (io.ReadCloser, error)
 	}
 }
 
-func checksumLine(s string) []byte {
-	digest := sha256.New()
-	digest.Write([]byte(s))
-	return digest.Sum(nil)
+// sleep waits for the duration, returning false if the context is cancelled
+// first.
+func sleep(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+func checksumLine(s string) [sha256.Size]byte {
+	return sha256.Sum256([]byte(s))
 }
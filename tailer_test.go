@@ -0,0 +1,382 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeConnection is what a fake log stream serves on one connection: the
+// log at that time, from which lines before the requested time are left
+// out, as the API server does, and how many of them to send before
+// disconnecting.
+type fakeConnection struct {
+	log     []string
+	deliver int   // Number of lines to send; all if negative
+	err     error // Returned after the lines instead of io.EOF
+}
+
+type failingReader struct {
+	err error
+}
+
+func (r failingReader) Read([]byte) (int, error) {
+	return 0, r.err
+}
+
+// fakeTailerResult is what a tailer emitted while reading fake streams.
+type fakeTailerResult struct {
+	lines  []string
+	events []LogEvent
+	gaps   []string
+	sinces []string // Time requested for each connection
+	errors []error
+	tailer *ContainerTailer
+}
+
+// runFakeTailer runs a tailer against a fake log stream until the
+// connections have all been used.
+func runFakeTailer(t *testing.T, options ContainerTailerOptions, connections []fakeConnection) *fakeTailerResult {
+	t.Helper()
+
+	result := &fakeTailerResult{}
+	pod := newTestPod("default", "web")
+	var ct *ContainerTailer
+	ct = NewContainerTailer(context.Background(), nil, *pod, pod.Spec.Containers[0], options,
+		ContainerTailerCallbacks{
+			OnEvent: func(event LogEvent) {
+				result.lines = append(result.lines, formatFakeLine(*event.Timestamp, event.Message))
+				result.events = append(result.events, event)
+			},
+			OnGap: func(from, to time.Time) {
+				result.gaps = append(result.gaps, fmt.Sprintf("%s-%s",
+					from.UTC().Format(time.RFC3339Nano), to.UTC().Format(time.RFC3339Nano)))
+			},
+		})
+	ct.errorBackoff.Min = time.Millisecond
+	ct.openStream = func(context.Context) (io.ReadCloser, error) {
+		if len(connections) == 0 {
+			// The container has gone
+			return nil, nil
+		}
+		conn := connections[0]
+		connections = connections[1:]
+
+		var since time.Time
+		if ct.fromTimestamp != nil {
+			since = ct.fromTimestamp.UTC()
+			result.sinces = append(result.sinces, since.Format(time.RFC3339Nano))
+		} else {
+			result.sinces = append(result.sinces, "")
+		}
+		// The API server only takes whole seconds
+		since = since.Truncate(time.Second)
+
+		var lines []string
+		for _, line := range conn.log {
+			timeString, _, _ := strings.Cut(line, " ")
+			if timestamp, err := time.Parse(time.RFC3339Nano, timeString); err == nil && timestamp.Before(since) {
+				continue
+			}
+			lines = append(lines, line+"\n")
+		}
+		if conn.deliver >= 0 && conn.deliver < len(lines) {
+			lines = lines[:conn.deliver]
+		}
+		var r io.Reader = strings.NewReader(strings.Join(lines, ""))
+		if conn.err != nil {
+			r = io.MultiReader(r, failingReader{conn.err})
+		}
+		return io.NopCloser(r), nil
+	}
+	ct.Run(func(err error) {
+		result.errors = append(result.errors, err)
+	})
+	result.tailer = ct
+	return result
+}
+
+func formatFakeLine(timestamp time.Time, message string) string {
+	return timestamp.UTC().Format(time.RFC3339Nano) + " " + message
+}
+
+// burst returns lines logged at the given second, each at the given
+// millisecond offset.
+func burst(second int, lines ...string) []string {
+	base := time.Date(2024, 5, 1, 12, 0, second, 0, time.UTC)
+	result := make([]string, len(lines))
+	for i, line := range lines {
+		ms, message, _ := strings.Cut(line, " ")
+		var offset int
+		_, _ = fmt.Sscanf(ms, "%d", &offset)
+		result[i] = formatFakeLine(base.Add(time.Duration(offset)*time.Millisecond), message)
+	}
+	return result
+}
+
+func concat(parts ...[]string) []string {
+	var result []string
+	for _, part := range parts {
+		result = append(result, part...)
+	}
+	return result
+}
+
+func TestTailerReconnect(t *testing.T) {
+	log := concat(
+		burst(1, "500 before"),
+		burst(2, "100 a", "100 b", "200 same", "200 same", "300 c", "300 d"),
+		burst(3, "0 after"))
+
+	for _, tc := range []struct {
+		name        string
+		connections []fakeConnection
+		sinces      []string
+		expected    []string
+		gaps        int
+	}{
+		{
+			name:        "no disconnect",
+			connections: []fakeConnection{{log: log, deliver: -1}},
+			sinces:      []string{""},
+			expected:    log,
+		},
+		{
+			name: "disconnect mid-burst, burst partly replayed",
+			connections: []fakeConnection{
+				{log: log, deliver: 3},
+				{log: log, deliver: -1},
+			},
+			sinces:   []string{"", "2024-05-01T12:00:02.1Z"},
+			expected: log,
+		},
+		{
+			name: "disconnect between identical lines at the same time",
+			connections: []fakeConnection{
+				{log: log, deliver: 4},
+				{log: log, deliver: -1},
+			},
+			sinces:   []string{"", "2024-05-01T12:00:02.2Z"},
+			expected: log,
+		},
+		{
+			name: "disconnect after burst, burst fully replayed",
+			connections: []fakeConnection{
+				{log: log, deliver: 7},
+				{log: log, deliver: -1},
+			},
+			sinces:   []string{"", "2024-05-01T12:00:02.3Z"},
+			expected: log,
+		},
+		{
+			name: "disconnect with error, and several times",
+			connections: []fakeConnection{
+				{log: log, deliver: 2, err: errors.New("connection reset")},
+				{log: log, deliver: 2},
+				{log: log[:5], deliver: -1, err: errors.New("connection reset")},
+				{log: log, deliver: -1},
+			},
+			sinces: []string{"", "2024-05-01T12:00:02.1Z", "2024-05-01T12:00:02.1Z",
+				"2024-05-01T12:00:02.2Z"},
+			expected: log,
+		},
+		{
+			name: "nothing new after reconnecting",
+			connections: []fakeConnection{
+				{log: log[:4], deliver: -1},
+				{log: log[:4], deliver: -1},
+				{log: log, deliver: -1},
+			},
+			sinces:   []string{"", "2024-05-01T12:00:02.2Z", "2024-05-01T12:00:02.2Z"},
+			expected: log,
+		},
+		{
+			name: "replayed lines missing after log rotation",
+			connections: []fakeConnection{
+				{log: log, deliver: 3},
+				{log: concat(burst(2, "300 d"), burst(3, "0 after")), deliver: -1},
+			},
+			sinces:   []string{"", "2024-05-01T12:00:02.1Z"},
+			expected: concat(log[:3], burst(2, "300 d"), burst(3, "0 after")),
+			gaps:     1,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			result := runFakeTailer(t, ContainerTailerOptions{}, tc.connections)
+			if got, expected := strings.Join(result.lines, "\n"), strings.Join(tc.expected, "\n"); got != expected {
+				t.Errorf("got lines:\n%s\nexpected:\n%s", got, expected)
+			}
+			if got, expected := strings.Join(result.sinces, ","), strings.Join(tc.sinces, ","); got != expected {
+				t.Errorf("got since times %s, expected %s", got, expected)
+			}
+			if len(result.gaps) != tc.gaps {
+				t.Errorf("got gaps %v, expected %d", result.gaps, tc.gaps)
+			}
+		})
+	}
+}
+
+func TestTailerReportsGapFromLastLine(t *testing.T) {
+	result := runFakeTailer(t, ContainerTailerOptions{}, []fakeConnection{
+		{log: burst(2, "100 a", "200 b"), deliver: -1},
+		{log: burst(5, "0 c"), deliver: -1},
+	})
+	expected := "2024-05-01T12:00:02.2Z-2024-05-01T12:00:05Z"
+	if len(result.gaps) != 1 || result.gaps[0] != expected {
+		t.Errorf("got gaps %v, expected %s", result.gaps, expected)
+	}
+}
+
+func TestTailerResumesFromCheckpoint(t *testing.T) {
+	log := concat(
+		burst(2, "100 a", "200 b", "200 b", "300 stdout P c1 ", "300 stdout F c2"),
+		burst(3, "0 d"))
+
+	for _, tc := range []struct {
+		name     string
+		received int // Lines received by the first tailer
+		output   int // Of which were output
+	}{
+		{name: "nothing output", received: 2, output: 0},
+		{name: "all received lines output", received: 3, output: 3},
+		{name: "between identical lines", received: 3, output: 2},
+		{name: "received lines not output yet", received: 4, output: 1},
+		{name: "joined partial line output", received: 5, output: 4},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			first := runFakeTailer(t, ContainerTailerOptions{}, []fakeConnection{{log: log, deliver: tc.received}})
+			for _, event := range first.events[:tc.output] {
+				event.onOutput()
+			}
+			checkpoint := first.tailer.Checkpoint()
+			if tc.output == 0 && checkpoint != nil {
+				t.Errorf("got checkpoint %+v with nothing output", checkpoint)
+			}
+
+			second := runFakeTailer(t, ContainerTailerOptions{Checkpoint: checkpoint},
+				[]fakeConnection{{log: log, deliver: -1}})
+			expected := concat(burst(2, "100 a", "200 b", "200 b", "300 c1 c2"), burst(3, "0 d"))
+			if got, expected := strings.Join(append(first.lines[:tc.output], second.lines...), "\n"),
+				strings.Join(expected, "\n"); got != expected {
+				t.Errorf("got lines:\n%s\nexpected:\n%s", got, expected)
+			}
+			if len(second.gaps) != 0 {
+				t.Errorf("got gaps %v", second.gaps)
+			}
+		})
+	}
+}
+
+func TestTailerJoinsPartialLines(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		connections []fakeConnection
+		expected    []string
+	}{
+		{
+			name: "pieces of one line",
+			connections: []fakeConnection{{log: burst(2,
+				"100 stdout P first ", "100 stdout P second ", "200 stdout F third",
+				"300 stdout F next"), deliver: -1}},
+			expected: burst(2, "100 first second third", "300 stdout F next"),
+		},
+		{
+			name: "lines from the other stream in between",
+			connections: []fakeConnection{{log: burst(2,
+				"100 stdout P out1 ", "150 stderr P err1 ", "160 stderr F err2", "200 stdout F out2"), deliver: -1}},
+			expected: burst(2, "150 err1 err2", "100 out1 out2"),
+		},
+		{
+			name: "final piece from the other stream",
+			connections: []fakeConnection{{log: burst(2,
+				"100 stdout P out1 ", "150 stderr F err", "200 stdout F out2"), deliver: -1}},
+			expected: burst(2, "150 stderr F err", "100 out1 out2"),
+		},
+		{
+			name: "empty final piece",
+			connections: []fakeConnection{{log: burst(2,
+				"100 stdout P whole line", "200 stdout F"), deliver: -1}},
+			expected: burst(2, "100 whole line"),
+		},
+		{
+			name: "disconnect between pieces",
+			connections: []fakeConnection{
+				{log: burst(2, "100 stdout P first ", "100 stdout P second ", "200 stdout F third"), deliver: 1},
+				{log: burst(2, "100 stdout P first ", "100 stdout P second ", "200 stdout F third"), deliver: -1},
+			},
+			expected: burst(2, "100 first second third"),
+		},
+		{
+			name: "stream ends before the final piece",
+			connections: []fakeConnection{{log: burst(2,
+				"100 stdout P out ", "150 stderr P err", "200 stdout P more"), deliver: -1}},
+			expected: burst(2, "100 out more", "150 err"),
+		},
+		{
+			name: "rest of the line lost after log rotation",
+			connections: []fakeConnection{
+				{log: burst(2, "100 stdout P first ", "200 stdout P second "), deliver: -1},
+				{log: burst(3, "0 stdout F other"), deliver: -1},
+			},
+			expected: concat(burst(2, "100 first second "), burst(3, "0 stdout F other")),
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			result := runFakeTailer(t, ContainerTailerOptions{}, tc.connections)
+			if got, expected := strings.Join(result.lines, "\n"), strings.Join(tc.expected, "\n"); got != expected {
+				t.Errorf("got lines:\n%s\nexpected:\n%s", got, expected)
+			}
+		})
+	}
+}
+
+func TestTailerSplitsOverlongPartialLines(t *testing.T) {
+	piece := strings.Repeat("x", maxPartialLineSize/2)
+	var log []string
+	for i := 0; i < 3; i++ {
+		log = append(log, burst(2, fmt.Sprintf("%d stdout P %s", 100+i, piece))...)
+	}
+	log = append(log, burst(2, "200 stdout F end")...)
+
+	result := runFakeTailer(t, ContainerTailerOptions{}, []fakeConnection{{log: log, deliver: -1}})
+	expected := burst(2, "100 "+piece+piece, "102 "+piece+"end")
+	if len(result.lines) != len(expected) || result.lines[0] != expected[0] || result.lines[1] != expected[1] {
+		t.Errorf("got %d lines, expected %d", len(result.lines), len(expected))
+	}
+}
+
+func TestTailerMalformedLines(t *testing.T) {
+	log := []string{"not a timestamp", "2024-05-01T12:00:02Z good", "nospace"}
+	for _, passMalformed := range []bool{false, true} {
+		pod := newTestPod("default", "web")
+		var lines, malformed []string
+		ct := NewContainerTailer(context.Background(), nil, *pod, pod.Spec.Containers[0],
+			ContainerTailerOptions{PassMalformed: passMalformed},
+			ContainerTailerCallbacks{
+				OnEvent: func(event LogEvent) {
+					lines = append(lines, event.Message)
+				},
+				OnMalformed: func(line string, count int) {
+					malformed = append(malformed, fmt.Sprintf("%d:%s", count, line))
+				},
+			})
+		for _, line := range log {
+			ct.receiveLine(line + "\n")
+		}
+
+		expected := "good"
+		if passMalformed {
+			expected = "not a timestamp,good,nospace"
+		}
+		if got := strings.Join(lines, ","); got != expected {
+			t.Errorf("with passMalformed %v, got lines %q, expected %q", passMalformed, got, expected)
+		}
+		if got := strings.Join(malformed, ","); got != "1:not a timestamp,2:nospace" {
+			t.Errorf("got malformed lines %q", got)
+		}
+	}
+}
@@ -1,8 +1,11 @@
 package main
 
 import (
+	"bytes"
 	"io"
 	"os"
+	"time"
+	"unicode/utf8"
 
 	"golang.org/x/crypto/ssh/terminal"
 )
@@ -13,3 +16,140 @@ func isTerminal(w io.Writer) bool {
 	}
 	return false
 }
+
+// makeRaw puts a terminal into raw mode, so that key presses can be read one
+// at a time. It returns a function that restores the previous mode.
+func makeRaw(f *os.File) (func(), error) {
+	state, err := terminal.MakeRaw(int(f.Fd()))
+	if err != nil {
+		return nil, err
+	}
+	return func() {
+		_ = terminal.Restore(int(f.Fd()), state)
+	}, nil
+}
+
+// readKeys reads key presses from a terminal in raw mode. The channel is
+// closed when reading fails.
+func readKeys(r io.Reader) <-chan byte {
+	keys := make(chan byte, 16)
+	go func() {
+		defer close(keys)
+		buf := make([]byte, 16)
+		for {
+			n, err := r.Read(buf)
+			if err != nil {
+				return
+			}
+			for _, b := range buf[:n] {
+				keys <- b
+			}
+		}
+	}()
+	return keys
+}
+
+// keyPress is a decoded key press. Special keys have a name, such as "up" or
+// "enter"; other keys are represented by their rune.
+type keyPress struct {
+	name string
+	r    rune
+}
+
+var escapeSequenceKeys = map[string]string{
+	"A": "up", "B": "down", "C": "right", "D": "left", "H": "home", "F": "end",
+	"1~": "home", "7~": "home", "4~": "end", "8~": "end", "5~": "pgup", "6~": "pgdn",
+}
+
+// decodeKeys decodes the raw bytes read from a terminal into key presses,
+// including multi-byte characters and the escape sequences of arrow and
+// paging keys.
+func decodeKeys(in <-chan byte) <-chan keyPress {
+	keys := make(chan keyPress, 16)
+	go func() {
+		defer close(keys)
+
+		// next waits briefly for the next byte, which distinguishes the Escape
+		// key from the start of an escape sequence
+		next := func() (byte, bool) {
+			select {
+			case b, ok := <-in:
+				return b, ok
+			case <-time.After(25 * time.Millisecond):
+				return 0, false
+			}
+		}
+
+		for b := range in {
+			switch {
+			case b == 0x1b:
+				b2, ok := next()
+				if !ok || (b2 != '[' && b2 != 'O') {
+					keys <- keyPress{name: "esc"}
+					continue
+				}
+				var seq []byte
+				for {
+					b3, ok := next()
+					if !ok {
+						break
+					}
+					seq = append(seq, b3)
+					if b3 >= 0x40 && b3 <= 0x7e {
+						break
+					}
+				}
+				if name, ok := escapeSequenceKeys[string(seq)]; ok {
+					keys <- keyPress{name: name}
+				}
+			case b == '\r' || b == '\n':
+				keys <- keyPress{name: "enter"}
+			case b == 0x7f || b == 0x08:
+				keys <- keyPress{name: "backspace"}
+			case b == 0x03:
+				keys <- keyPress{name: "ctrl-c"}
+			case b == '\t':
+				keys <- keyPress{name: "tab"}
+			case b < 0x20:
+				// Ignore other control characters
+			case b < utf8.RuneSelf:
+				keys <- keyPress{r: rune(b)}
+			default:
+				buf := []byte{b}
+				for !utf8.FullRune(buf) {
+					b2, ok := next()
+					if !ok {
+						break
+					}
+					buf = append(buf, b2)
+				}
+				r, _ := utf8.DecodeRune(buf)
+				keys <- keyPress{r: r}
+			}
+		}
+	}()
+	return keys
+}
+
+// terminalSize returns the size of a terminal, or a default size if it
+// cannot be determined.
+func terminalSize(f *os.File) (width, height int) {
+	width, height, err := terminal.GetSize(int(f.Fd()))
+	if err != nil || width <= 0 || height <= 0 {
+		return 80, 24
+	}
+	return width, height
+}
+
+// crlfWriter translates line feeds into carriage return/line feed pairs,
+// which a terminal in raw mode needs to start output on a new line.
+type crlfWriter struct {
+	w io.Writer
+}
+
+func (cw crlfWriter) Write(p []byte) (int, error) {
+	if _, err := cw.w.Write(bytes.ReplaceAll(p, []byte("\n"), []byte("\r\n"))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
@@ -0,0 +1,16 @@
+//go:build !linux && !darwin && !dragonfly && !freebsd && !netbsd && !openbsd && !windows
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+func makeCbreak(*os.File) (func(), error) {
+	return nil, errors.New("not supported on this platform")
+}
+
+func isForeground(*os.File) bool {
+	return true
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"os"
+
+	"golang.org/x/sys/windows"
+)
+
+// makeCbreak turns off line buffering and echoing, so that key presses can
+// be read one at a time, but leaves Ctrl+C generating a signal. It returns a
+// function that restores the previous mode.
+func makeCbreak(f *os.File) (func(), error) {
+	handle := windows.Handle(f.Fd())
+	var mode uint32
+	if err := windows.GetConsoleMode(handle, &mode); err != nil {
+		return nil, err
+	}
+	if err := windows.SetConsoleMode(handle, mode&^(windows.ENABLE_ECHO_INPUT|windows.ENABLE_LINE_INPUT)); err != nil {
+		return nil, err
+	}
+	return func() {
+		_ = windows.SetConsoleMode(handle, mode)
+	}, nil
+}
+
+// isForeground returns true, as Windows has no background processes that
+// share a console.
+func isForeground(*os.File) bool {
+	return true
+}
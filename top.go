@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+type topColumn string
+
+const (
+	topColumnName     topColumn = "name"
+	topColumnLines    topColumn = "lines"
+	topColumnBytes    topColumn = "bytes"
+	topColumnErrors   topColumn = "errors"
+	topColumnTotal    topColumn = "total"
+	topColumnLastSeen topColumn = "last"
+)
+
+// topColumnKeys maps key presses to the column to sort by.
+var topColumnKeys = map[rune]topColumn{
+	'n': topColumnName,
+	'l': topColumnLines,
+	'b': topColumnBytes,
+	'e': topColumnErrors,
+	't': topColumnTotal,
+	's': topColumnLastSeen,
+}
+
+func parseTopColumn(s string) (topColumn, error) {
+	for _, c := range topColumnKeys {
+		if string(c) == s {
+			return c, nil
+		}
+	}
+	return "", fmt.Errorf("invalid sort column %q (must be one of name, lines, bytes, errors, total, last)", s)
+}
+
+type topRow struct {
+	name         string
+	linesPerSec  float64
+	bytesPerSec  float64
+	errorsPerSec float64
+	total        int64
+	lastSeen     time.Time
+	left         bool
+}
+
+// TopView periodically prints a table of log throughput per container,
+// computed from the statistics collected by Stats.
+type TopView struct {
+	stats      *Stats
+	out        io.Writer
+	interval   time.Duration
+	sortBy     topColumn
+	reverse    bool
+	live       bool
+	formatName func(namespace, pod, container string) string
+	prev       map[string]ContainerStatsSnapshot
+	prevTime   time.Time
+	rows       []topRow
+}
+
+func NewTopView(
+	stats *Stats,
+	out io.Writer,
+	interval time.Duration,
+	sortBy topColumn,
+	live bool,
+	formatName func(namespace, pod, container string) string) *TopView {
+	return &TopView{
+		stats:      stats,
+		out:        out,
+		interval:   interval,
+		sortBy:     sortBy,
+		live:       live,
+		formatName: formatName,
+		prevTime:   time.Now(),
+	}
+}
+
+// Run refreshes the table until the context is cancelled. Key presses read
+// from keys change the sort order; 'q' and Ctrl+C call quit.
+func (tv *TopView) Run(ctx context.Context, keys <-chan keyPress, quit func()) {
+	ticker := time.NewTicker(tv.interval)
+	defer ticker.Stop()
+
+	tv.sample()
+	tv.print()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			tv.sample()
+			tv.print()
+		case key, ok := <-keys:
+			if !ok {
+				keys = nil
+				continue
+			}
+			switch {
+			case key.r == 'q', key.name == "ctrl-c": // Ctrl+C does not generate a signal in raw mode
+				quit()
+				return
+			case key.r == 'r':
+				tv.reverse = !tv.reverse
+			default:
+				column, ok := topColumnKeys[key.r]
+				if !ok {
+					continue
+				}
+				tv.sortBy = column
+			}
+			tv.print()
+		}
+	}
+}
+
+func (tv *TopView) sample() {
+	now := time.Now()
+	elapsed := now.Sub(tv.prevTime).Seconds()
+	snapshot := tv.stats.Snapshot()
+
+	tv.rows = tv.rows[:0]
+	for key, cs := range snapshot {
+		prev := tv.prev[key]
+		row := topRow{
+			name:     tv.formatName(cs.Namespace, cs.Pod, cs.Container),
+			total:    cs.Lines,
+			lastSeen: cs.LastSeen,
+			left:     cs.Left,
+		}
+		if elapsed > 0 {
+			row.linesPerSec = float64(cs.Lines-prev.Lines) / elapsed
+			row.bytesPerSec = float64(cs.Bytes-prev.Bytes) / elapsed
+			row.errorsPerSec = float64(cs.Errors-prev.Errors) / elapsed
+		}
+		tv.rows = append(tv.rows, row)
+	}
+	tv.prev = snapshot
+	tv.prevTime = now
+}
+
+func (tv *TopView) print() {
+	rows := tv.rows
+	sort.SliceStable(rows, func(i, j int) bool {
+		a, b := rows[i], rows[j]
+		if tv.reverse {
+			a, b = b, a
+		}
+		switch tv.sortBy {
+		case topColumnLines:
+			if a.linesPerSec != b.linesPerSec {
+				return a.linesPerSec > b.linesPerSec
+			}
+		case topColumnBytes:
+			if a.bytesPerSec != b.bytesPerSec {
+				return a.bytesPerSec > b.bytesPerSec
+			}
+		case topColumnErrors:
+			if a.errorsPerSec != b.errorsPerSec {
+				return a.errorsPerSec > b.errorsPerSec
+			}
+		case topColumnTotal:
+			if a.total != b.total {
+				return a.total > b.total
+			}
+		case topColumnLastSeen:
+			if !a.lastSeen.Equal(b.lastSeen) {
+				return a.lastSeen.After(b.lastSeen)
+			}
+		}
+		return a.name < b.name
+	})
+
+	var sb strings.Builder
+	if tv.live {
+		sb.WriteString("\x1b[H\x1b[2J")
+	}
+	order := "descending"
+	if tv.reverse {
+		order = "ascending"
+	}
+	_, _ = fmt.Fprintf(&sb, "%s: %d containers, sorted by %s (%s)\n",
+		time.Now().Format(time.TimeOnly), len(rows), tv.sortBy, order)
+	if tv.live {
+		sb.WriteString("Sort: [n]ame [l]ines/s [b]ytes/s [e]rrors/s [t]otal last [s]een; [r]everse; [q]uit\n")
+	}
+	sb.WriteString("\n")
+
+	tw := tabwriter.NewWriter(&sb, 0, 4, 2, ' ', tabwriter.AlignRight)
+	_, _ = fmt.Fprintln(tw, "LINES/S\tBYTES/S\tERRORS/S\tTOTAL\tLAST SEEN\t  CONTAINER")
+	for _, row := range rows {
+		lastSeen := "never"
+		if !row.lastSeen.IsZero() {
+			lastSeen = formatDuration(time.Since(row.lastSeen).Truncate(time.Second)) + " ago"
+		}
+		name := row.name
+		if row.left {
+			name += " (left)"
+		}
+		_, _ = fmt.Fprintf(tw, "%.1f\t%s\t%.1f\t%d\t%s\t  %s\n",
+			row.linesPerSec, formatBytes(int64(row.bytesPerSec)), row.errorsPerSec, row.total, lastSeen, name)
+	}
+	_ = tw.Flush()
+
+	_, _ = io.WriteString(tv.out, sb.String())
+}
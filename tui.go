@@ -0,0 +1,549 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/fatih/color"
+)
+
+const (
+	tuiSidebarWidth = 32
+	tuiFrameRate    = 50 * time.Millisecond
+)
+
+var ansiEscapeExpr = regexp.MustCompile(`\x1b\[[0-9;?]*[a-zA-Z]`)
+
+type tuiEntry struct {
+	seq     int64
+	key     string // Empty for messages from ktail itself
+	event   *LogEvent
+	message string // Only for messages from ktail itself
+}
+
+type tuiLine struct {
+	label string
+	color colorConfig
+	text  string
+	info  bool
+}
+
+// TUI is a full-screen interactive view of the merged stream, with a
+// sidebar of tailed containers. Containers can be muted or soloed, the
+// stream can be paused, scrolled back and filtered, and timestamps and JSON
+// pretty-printing can be toggled, all without affecting the tailers.
+type TUI struct {
+	getTailers func() []TailerInfo
+	tailers    []TailerInfo // Active tailers, refreshed before every update
+	out        *os.File
+	formatName func(namespace, pod, container string) string
+	maxHistory int
+
+	history    []tuiEntry
+	seq        int64
+	pausedSeq  int64
+	paused     bool
+	scroll     int
+	muted      map[string]bool
+	solo       string
+	filter     *regexp.Regexp
+	filterText string
+	editing    bool
+	input      string
+	timestamps bool
+	prettyJSON bool
+	selected   int
+	showHelp   bool
+	dirty      bool
+	sync.Mutex
+}
+
+func NewTUI(
+	getTailers func() []TailerInfo,
+	out *os.File,
+	maxHistory int,
+	timestamps bool,
+	formatName func(namespace, pod, container string) string) *TUI {
+	return &TUI{
+		getTailers: getTailers,
+		out:        out,
+		formatName: formatName,
+		maxHistory: maxHistory,
+		muted:      map[string]bool{},
+		timestamps: timestamps,
+		dirty:      true,
+	}
+}
+
+// Write adds an event to the history.
+func (t *TUI) Write(event *LogEvent) {
+	t.Lock()
+	defer t.Unlock()
+	t.append(tuiEntry{key: logEventKey(event), event: event})
+}
+
+// tuiMessageWriter is an io.Writer that adds messages from ktail itself, such
+// as containers coming and going, to the history.
+type tuiMessageWriter struct {
+	tui *TUI
+}
+
+func (w tuiMessageWriter) Write(p []byte) (int, error) {
+	w.tui.Lock()
+	defer w.tui.Unlock()
+	for _, line := range strings.Split(strings.TrimRight(string(p), "\n"), "\n") {
+		w.tui.append(tuiEntry{message: ansiEscapeExpr.ReplaceAllString(line, "")})
+	}
+	return len(p), nil
+}
+
+func (t *TUI) append(entry tuiEntry) {
+	t.seq++
+	entry.seq = t.seq
+	if len(t.history) >= t.maxHistory {
+		t.history = t.history[1:]
+	}
+	t.history = append(t.history, entry)
+	t.dirty = true
+}
+
+// Run takes over the terminal and handles key presses until the context is
+// cancelled or the user quits.
+func (t *TUI) Run(ctx context.Context, keys <-chan keyPress, quit func()) {
+	_, _ = t.out.WriteString("\x1b[?1049h\x1b[?25l")
+	defer func() {
+		_, _ = t.out.WriteString("\x1b[?25h\x1b[?1049l")
+	}()
+
+	ticker := time.NewTicker(tuiFrameRate)
+	defer ticker.Stop()
+
+	lastWidth, lastHeight := 0, 0
+	lastRender := time.Time{}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case key, ok := <-keys:
+			if !ok {
+				keys = nil
+				continue
+			}
+			tailers := t.getTailers()
+			t.Lock()
+			t.setTailers(tailers)
+			done := t.handleKey(key)
+			t.dirty = true
+			t.Unlock()
+			if done {
+				quit()
+				return
+			}
+		case <-ticker.C:
+			// Redraw when something changed, and periodically to keep the
+			// sidebar and terminal size current
+			width, height := terminalSize(t.out)
+			tailers := t.getTailers()
+			t.Lock()
+			t.setTailers(tailers)
+			if width != lastWidth || height != lastHeight || time.Since(lastRender) > time.Second {
+				t.dirty = true
+				lastWidth, lastHeight = width, height
+			}
+			if t.dirty {
+				t.render(width, height)
+				t.dirty = false
+				lastRender = time.Now()
+			}
+			t.Unlock()
+		}
+	}
+}
+
+func (t *TUI) handleKey(key keyPress) bool {
+	if t.editing {
+		switch key.name {
+		case "enter":
+			t.editing = false
+			t.setFilter(t.input)
+		case "esc":
+			t.editing = false
+		case "backspace":
+			if len(t.input) > 0 {
+				_, size := utf8.DecodeLastRuneInString(t.input)
+				t.input = t.input[:len(t.input)-size]
+			}
+		case "ctrl-c":
+			return true
+		case "":
+			t.input += string(key.r)
+		}
+		return false
+	}
+
+	containers := t.containerKeys()
+	switch key.name {
+	case "ctrl-c":
+		return true
+	case "up":
+		t.selected = max(0, t.selected-1)
+	case "down":
+		t.selected = min(len(containers)-1, t.selected+1)
+	case "pgup":
+		t.pause()
+		t.scroll += 10
+	case "pgdn":
+		t.scroll = max(0, t.scroll-10)
+	case "home":
+		t.pause()
+		t.scroll = len(t.history) * 2
+	case "end":
+		t.resume()
+	case "esc":
+		t.showHelp = false
+		t.setFilter("")
+	}
+
+	switch key.r {
+	case 'q':
+		return true
+	case 'k':
+		t.selected = max(0, t.selected-1)
+	case 'j':
+		t.selected = min(len(containers)-1, t.selected+1)
+	case 'p', ' ':
+		if t.paused {
+			t.resume()
+		} else {
+			t.pause()
+		}
+	case 'b':
+		t.pause()
+		t.scroll += 10
+	case 'f':
+		t.scroll = max(0, t.scroll-10)
+	case 'G':
+		t.resume()
+	case '/':
+		t.editing = true
+		t.input = t.filterText
+	case 'm':
+		if t.selected >= 0 && t.selected < len(containers) {
+			key := containers[t.selected]
+			t.muted[key] = !t.muted[key]
+		}
+	case 's':
+		if t.selected >= 0 && t.selected < len(containers) {
+			if key := containers[t.selected]; t.solo == key {
+				t.solo = ""
+			} else {
+				t.solo = key
+			}
+		}
+	case 'c':
+		t.muted = map[string]bool{}
+		t.solo = ""
+	case 't':
+		t.timestamps = !t.timestamps
+	case 'J':
+		t.prettyJSON = !t.prettyJSON
+	case '?', 'h':
+		t.showHelp = !t.showHelp
+	}
+	return false
+}
+
+func (t *TUI) pause() {
+	if !t.paused {
+		t.paused = true
+		t.pausedSeq = t.seq
+	}
+}
+
+func (t *TUI) resume() {
+	t.paused = false
+	t.scroll = 0
+}
+
+func (t *TUI) setFilter(s string) {
+	t.filterText = s
+	t.filter = nil
+	if s == "" {
+		return
+	}
+	r, err := regexp.Compile(s)
+	if err != nil {
+		// Treat invalid expressions as plain text
+		r = regexp.MustCompile(regexp.QuoteMeta(s))
+	}
+	t.filter = r
+}
+
+// setTailers updates the sidebar. The tailers must be fetched from the
+// controller before locking, since the controller may call back into the TUI
+// while holding its own lock.
+func (t *TUI) setTailers(tailers []TailerInfo) {
+	active := make([]TailerInfo, 0, len(tailers))
+	for _, info := range tailers {
+		if info.Active {
+			active = append(active, info)
+		}
+	}
+	if len(active) != len(t.tailers) {
+		t.dirty = true
+	}
+	t.tailers = active
+}
+
+// containerKeys returns the keys of the active tailers, in sidebar order.
+func (t *TUI) containerKeys() []string {
+	keys := make([]string, len(t.tailers))
+	for i, info := range t.tailers {
+		keys[i] = info.Namespace + "/" + info.Pod + "/" + info.Container
+	}
+	return keys
+}
+
+func (t *TUI) isVisible(entry *tuiEntry) bool {
+	if entry.event == nil {
+		return t.solo == "" && t.filter == nil
+	}
+	if t.solo != "" && entry.key != t.solo {
+		return false
+	}
+	if t.muted[entry.key] {
+		return false
+	}
+	return t.filter == nil || t.filter.MatchString(entry.event.Message)
+}
+
+func (t *TUI) formatEntry(entry *tuiEntry) []tuiLine {
+	if entry.event == nil {
+		return []tuiLine{{text: entry.message, info: true}}
+	}
+
+	event := entry.event
+	var containerName string
+	if event.Container != nil {
+		containerName = event.Container.Name
+	}
+	label := t.formatName(event.Pod.Namespace, event.Pod.Name, containerName)
+	if event.Container == nil {
+		label = strings.TrimSuffix(label, ":")
+	}
+	if t.timestamps {
+		label = formatTimestamp(event.Timestamp) + " " + label
+	}
+	col := getColorConfig(event.Pod.Name, containerName)
+
+	message := event.Message
+	if event.Kind == LogEventKindEvent {
+		message = fmt.Sprintf("[event] %s: %s", formatKubeEvent(event.Event), message)
+	}
+	if t.prettyJSON && len(message) >= 2 && message[0] == '{' && message[len(message)-1] == '}' {
+		var buf bytes.Buffer
+		if err := json.Indent(&buf, []byte(message), "", "  "); err == nil {
+			message = buf.String()
+		}
+	}
+
+	var lines []tuiLine
+	for i, text := range strings.Split(message, "\n") {
+		line := tuiLine{label: label, color: col, text: text}
+		if i > 0 {
+			line.label = strings.Repeat(" ", utf8.RuneCountInString(label))
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+func (t *TUI) render(width, height int) {
+	mainWidth := width
+	sidebarWidth := 0
+	if width >= tuiSidebarWidth*2 {
+		sidebarWidth = tuiSidebarWidth
+		mainWidth = width - sidebarWidth - 1
+	}
+	bodyHeight := max(1, height-2)
+
+	// Collect the lines to show, from the bottom up
+	var lines []tuiLine
+	skip := t.scroll
+	for i := len(t.history) - 1; i >= 0 && len(lines) < bodyHeight; i-- {
+		entry := &t.history[i]
+		if t.paused && entry.seq > t.pausedSeq {
+			continue
+		}
+		if !t.isVisible(entry) {
+			continue
+		}
+		entryLines := t.formatEntry(entry)
+		for j := len(entryLines) - 1; j >= 0 && len(lines) < bodyHeight; j-- {
+			if skip > 0 {
+				skip--
+				continue
+			}
+			lines = append(lines, entryLines[j])
+		}
+	}
+	if skip > 0 {
+		// Scrolled past the beginning of the history
+		t.scroll -= skip
+	}
+
+	var sidebar []string
+	if sidebarWidth > 0 {
+		sidebar = t.renderSidebar(sidebarWidth, bodyHeight)
+	}
+
+	var sb strings.Builder
+	sb.WriteString("\x1b[H")
+	sb.WriteString(t.renderHeader(width))
+	for row := 0; row < bodyHeight; row++ {
+		sb.WriteString("\r\n")
+		// Lines were collected bottom-up
+		if idx := bodyHeight - 1 - row; idx < len(lines) {
+			sb.WriteString(t.renderLine(&lines[idx], mainWidth))
+		} else {
+			sb.WriteString(strings.Repeat(" ", mainWidth))
+		}
+		if sidebarWidth > 0 {
+			sb.WriteString("│")
+			sb.WriteString(sidebar[row])
+		}
+	}
+	sb.WriteString("\r\n")
+	sb.WriteString(t.renderFooter(width))
+	_, _ = t.out.WriteString(sb.String())
+}
+
+func (t *TUI) renderHeader(width int) string {
+	parts := []string{"ktail"}
+	if t.paused {
+		parts = append(parts, fmt.Sprintf("PAUSED (%d new)", t.seq-t.pausedSeq))
+		if t.scroll > 0 {
+			parts = append(parts, fmt.Sprintf("scrolled up %d lines", t.scroll))
+		}
+	}
+	if t.filterText != "" {
+		parts = append(parts, fmt.Sprintf("filter: /%s/", t.filterText))
+	}
+	if t.solo != "" {
+		parts = append(parts, "solo: "+t.solo)
+	} else if n := countTrue(t.muted); n > 0 {
+		parts = append(parts, fmt.Sprintf("%d muted", n))
+	}
+	if t.timestamps {
+		parts = append(parts, "timestamps")
+	}
+	if t.prettyJSON {
+		parts = append(parts, "pretty JSON")
+	}
+	return color.New(color.ReverseVideo).Sprint(padRight(" "+strings.Join(parts, " | "), width))
+}
+
+func (t *TUI) renderFooter(width int) string {
+	if t.editing {
+		return padRight("Filter: "+t.input+"█", width)
+	}
+	if t.showHelp {
+		return padRight("[space/p] pause [b/f/PgUp/PgDn] scroll [G/End] follow [/] filter"+
+			" [↑↓/jk] select [m] mute [s] solo [c] clear [t] timestamps [J] JSON [q] quit", width)
+	}
+	return padRight("Press ? for help", width)
+}
+
+func (t *TUI) renderSidebar(width, height int) []string {
+	rows := make([]string, 0, height)
+	active := t.tailers
+	if t.selected >= len(active) {
+		t.selected = len(active) - 1
+	}
+	if t.selected < 0 {
+		t.selected = 0
+	}
+
+	offset := 0
+	if t.selected >= height {
+		offset = t.selected - height + 1
+	}
+	for i := offset; i < len(active) && len(rows) < height; i++ {
+		info := active[i]
+		key := info.Namespace + "/" + info.Pod + "/" + info.Container
+		mark := " "
+		switch {
+		case t.solo == key:
+			mark = "S"
+		case t.muted[key]:
+			mark = "M"
+		case info.Phase == TailerPhaseWaiting:
+			mark = "W"
+		case info.Phase != TailerPhaseStreaming:
+			mark = "?"
+		}
+		text := padRight(" "+mark+" "+t.formatName(info.Namespace, info.Pod, info.Container), width)
+		if i == t.selected {
+			text = color.New(color.ReverseVideo).Sprint(text)
+		} else if t.muted[key] || (t.solo != "" && t.solo != key) {
+			text = color.New(color.Faint).Sprint(text)
+		}
+		rows = append(rows, text)
+	}
+	for len(rows) < height {
+		rows = append(rows, strings.Repeat(" ", width))
+	}
+	return rows
+}
+
+func (t *TUI) renderLine(line *tuiLine, width int) string {
+	if line.info {
+		return colorInfo(padRight(line.text, width))
+	}
+	label := truncate(line.label, width)
+	text := padRight(sanitizeLine(line.text), width-utf8.RuneCountInString(label)-1)
+	return line.color.labels.Sprint(label) + " " + text
+}
+
+// sanitizeLine removes escape sequences and tabs from a message, which would
+// otherwise break the layout.
+func sanitizeLine(s string) string {
+	return strings.ReplaceAll(ansiEscapeExpr.ReplaceAllString(s, ""), "\t", "    ")
+}
+
+func truncate(s string, width int) string {
+	if width <= 0 {
+		return ""
+	}
+	if utf8.RuneCountInString(s) <= width {
+		return s
+	}
+	runes := []rune(s)
+	return string(runes[:width])
+}
+
+func padRight(s string, width int) string {
+	s = truncate(s, width)
+	if n := utf8.RuneCountInString(s); n < width {
+		s += strings.Repeat(" ", width-n)
+	}
+	return s
+}
+
+func countTrue(m map[string]bool) int {
+	n := 0
+	for _, v := range m {
+		if v {
+			n++
+		}
+	}
+	return n
+}